@@ -4,18 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
-	"github.com/lithammer/shortuuid/v4"
-	"html"
-	"log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net"
 	"net/http"
 	"nixiang-gpt/def"
 	"nixiang-gpt/s2s"
-	"regexp"
-	"strings"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -25,368 +27,362 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	waitTimeout    = 30 * time.Second
 )
+
+// waitTimeout bounds the wait for the upstream to take a request.
+var waitTimeout = 30 * time.Second
+
 const fnindex = 18
 
+var upstreamAddr = "wss://xxxxxxxxxxxxxxxx/queue/join"
+
+const defaultSystemPrompt = "Serve me as a writing and programming assistant."
+const maxChoices = 8
+
 func main() {
-	r := mux.NewRouter()
-	r.HandleFunc("/v1/chat/completions", handleChatCompletions).Methods("POST")
-	http.Handle("/", r)
-	log.Fatal(http.ListenAndServe(":28888", nil))
-}
+	flag.StringVar(&upstreamAddr, "upstream", upstreamAddr, "websocket address of the gpt_academic queue")
+	flag.IntVar(&upstreamRetry.attempts, "upstream-attempts", upstreamRetry.attempts,
+		"maximum upstream sessions per answer; failures before the first delta are retried")
+	flag.DurationVar(&upstreamRetry.backoff, "upstream-backoff", upstreamRetry.backoff,
+		"delay before the first retry, doubled for every further one")
+	flag.DurationVar(&upstreamRetry.maxBackoff, "upstream-max-backoff", upstreamRetry.maxBackoff,
+		"upper bound of the retry delay")
+	flag.StringVar(&recordDir, "record", "", "directory to record every upstream session to")
+	replay := flag.String("replay", "", "print the answer of a recorded session and exit")
+	logLevel := flag.String("log-level", "info", "minimum level of log records: debug, info, warn or error")
+	logFormat := flag.String("log-format", "json", "format of log records: json or text")
+	flag.Func("log-content", "how prompts and answers are logged: redact (only their size), truncate or full",
+		func(s string) (err error) {
+			logContent, err = parseContentPolicy(s)
+			return err
+		})
+	flag.IntVar(&logContentLimit, "log-content-limit", logContentLimit, "bytes of content logged with -log-content truncate")
+	flag.Func("metrics-keys", "comma-separated fingerprints of the API keys to count requests by, the first 8 hex digits of their SHA-256; other keys are counted as \"other\"",
+		parseMetricsKeys)
+	flag.DurationVar(&probeInterval, "probe-interval", probeInterval, "how often to probe the upstream mirrors; 0 disables probing")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"),
+		"bearer token of /v1/admin/upstreams, which is disabled without one; defaults to $ADMIN_TOKEN")
+	var lc listenConfig
+	flag.StringVar(&lc.addr, "listen", ":28888", "address to listen on, or unix:<path> for a Unix socket")
+	flag.StringVar(&lc.certFile, "tls-cert", "", "certificate file to serve TLS with; reloaded when it changes")
+	flag.StringVar(&lc.keyFile, "tls-key", "", "private key file of -tls-cert")
+	flag.StringVar(&lc.clientCAFile, "tls-client-ca", "", "CA certificates file; clients must present a certificate signed by one of them")
+	flag.BoolVar(&lc.h2c, "h2c", false, "serve HTTP/2 without TLS as well as HTTP/1.1")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout,
+		"how long active requests may take to finish on SIGINT or SIGTERM before they are cancelled")
+	traceExporter := flag.String("trace", "none", "trace exporter: otlp (configured by OTEL_EXPORTER_OTLP_*), stdout or none")
+	flag.Parse()
+
+	l, err := newLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(l)
 
-func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	var req def.OpenAIChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if *replay != "" {
+		answer, err := replayRecording(*replay)
+		fmt.Println(answer)
+		if err != nil {
+			slog.Error("replaying recording", "path", *replay, "error", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	// Extract the user message and previous conversations
-	var userMessage string
-	var previousConversations [][]string
-	previousConversations = s2s.ExtractConversations(req.Messages)
-	userMessage = previousConversations[len(previousConversations)-1][0]
-	previousConversations = previousConversations[:len(previousConversations)-1]
-	//每次从req.Messages中提取用户消息和之前的对话，role为user、assistant为一对，system则跳过，如果user后面跟着又是user则说明没有回答，则user自成一对
-
-	client, err := NewClient("wss://xxxxxxxxxxxxxxxx/queue/join")
+	shutdownTracing, err := setupTracing(context.Background(), *traceExporter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		slog.Error("setting up tracing", "error", err)
+		os.Exit(2)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	messageChan, err := client.SendMessage(ctx, userMessage, req.Model, previousConversations)
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go monitorUpstreams(signals)
+
+	http.Handle("/", newRouter())
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+
+	// Requests are cancelled through base when shutdown runs out of time.
+	base, cancelBase := context.WithCancelCause(context.Background())
+	srv := &http.Server{
+		BaseContext: func(net.Listener) context.Context { return base },
+		// Failed TLS handshakes, among others, are logged here.
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	ln, err := listen(lc.addr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		slog.Error("listening", "addr", lc.addr, "error", err)
+		os.Exit(1)
 	}
+	slog.Info("listening", "addr", ln.Addr().String(), "tls", lc.tls(), "client_auth", lc.clientCAFile != "", "h2c", lc.h2c)
+	served := make(chan error, 1)
+	go func() { served <- lc.serve(srv, ln) }()
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
+	select {
+	case err = <-served:
+		slog.Error("serving", "error", err)
+		shutdownTracing(context.Background())
+		os.Exit(1)
+	case <-signals.Done():
 	}
-
-	var lastResponse string
-	var lastEndIdx int
-	for {
-		select {
-		case msg, ok := <-messageChan:
-			if !ok {
-				return
-			}
-			//因为后端返回的内容中，针对markdown中的格式显示返回真实的开始例如```，但是后面的内容又会把这里修改为<code>造成错误，所以需要处理
-			msg = s2s.ProcessCodeSegments(msg, "<code>")
-			msg = s2s.ProcessCodeSegmentsEx(msg, "</code>")
-			msg = s2s.DealLine(msg)
-			//msg = s2s.ProcessCodeSegments(msg, "</code>")
-			//同理，针对代码快结束的位置，openai api是先返回``，然后再返回`\n，但是接口先返回``，后面又变成了</code>，从早晨增量返回没法闭合
-
-			latestResponse := strings.TrimRight(html.UnescapeString(stripHTML(msg)), "\n")
-			//latestResponse := s2s.DealRes(msg)
-			newPart := latestResponse
-			if len(lastResponse) > 0 && len(latestResponse) >= len(lastResponse) {
-				newPart = latestResponse[len(lastResponse):]
-			} else if len(lastResponse) > 0 {
-				newPart = ""
-			}
-			lastResponse = latestResponse
-			if strings.Contains(newPart, "1.") && strings.Contains(newPart, "- ") {
-				fmt.Println(newPart)
-			}
-
-			tmpEndIdx := strings.Index(msg[lastEndIdx:], ">\n``\n</code>")
-			if tmpEndIdx > 0 {
-				newPart = strings.ReplaceAll(newPart, "``", "```")
-				lastEndIdx = tmpEndIdx
-				lastResponse = lastResponse[:len(lastResponse)-2]
-			} else {
-				tmpEndIdx = strings.Index(msg[lastEndIdx:], ">``<")
-				if tmpEndIdx > 0 {
-					newPart = strings.ReplaceAll(newPart, "``", "```")
-					lastEndIdx = tmpEndIdx
-					lastResponse = lastResponse[:len(lastResponse)-2]
-				}
-			}
-			response := def.OpenAIChatResponse{
-				Choices: []def.OpenAIChatChoice{{
-					Delta: def.OpenAIChatDelta{Content: newPart},
-				}},
-			}
-			data, _ := json.Marshal(response)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-		case <-ctx.Done():
-			return
-		}
+	stopSignals()
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	shutdown(srv, cancelBase)
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Warn("flushing traces", "error", err)
 	}
+	slog.Info("stopped")
 }
 
-// Existing WebSocket client code
-type Client struct {
-	conn        *websocket.Conn
-	addr        string
-	sessionHash string
-	sendChan    chan []byte
-	receiveChan chan []byte
-	mu          sync.Mutex
-	isConnected bool
+// newRouter routes the API endpoints.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(traceRequests, logRequests, limitBodies, instrument)
+	r.HandleFunc("/v1/chat/completions", handleChatCompletions).Methods("POST")
+	r.HandleFunc("/v1/completions", handleCompletions).Methods("POST")
+	r.HandleFunc("/v1/messages", handleMessages).Methods("POST")
+	r.HandleFunc("/api/chat", handleOllamaChat).Methods("POST")
+	r.HandleFunc("/api/generate", handleOllamaGenerate).Methods("POST")
+	r.HandleFunc("/api/tags", handleOllamaTags).Methods("GET")
+	r.HandleFunc("/v1/admin/upstreams", requireAdmin(handleUpstreams)).Methods("GET")
+	return r
 }
 
-func NewClient(addr string) (*Client, error) {
-	c := &Client{
-		addr:        addr,
-		sessionHash: shortuuid.New(),
-		sendChan:    make(chan []byte, 256),
-		receiveChan: make(chan []byte, 256),
-	}
-
-	if err := c.connect(); err != nil {
-		return nil, err
-	}
-
-	go c.readPump()
-	go c.writePump()
+// maxRequestBody is the size limit of request bodies. Images inlined as data
+// URLs make requests large.
+const maxRequestBody = 32 << 20
 
-	return c, nil
+// limitBodies is the router middleware failing the reads of request bodies
+// over maxRequestBody, which the handlers report as request_too_large.
+func limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func (c *Client) connect() error {
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 45 * time.Second,
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req def.OpenAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, invalidRequest(err))
+		return
+	}
+	setRequestModel(r.Context(), req.Model)
+	if err := checkImageSupport(req.Model, req.Messages); err != nil {
+		writeError(w, invalidRequest(err))
+		return
 	}
-	conn, _, err := dialer.Dial(c.addr, nil)
+	tools, err := toolPrompt(req.Tools, req.ToolChoice)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		writeError(w, invalidRequest(err))
+		return
 	}
-	c.conn = conn
-	c.isConnected = true
-	return nil
-}
-
-func (c *Client) SendMessage(ctx context.Context, message string, model string, previousConversations [][]string) (<-chan string, error) {
-	responseChan := make(chan string)
-
-	go c.handleMessageExchange(ctx, message, model, previousConversations, responseChan)
-
-	return responseChan, nil
-}
-
-func (c *Client) handleMessageExchange(ctx context.Context, message string, model string, previousConversations [][]string, responseChan chan<- string) {
-	defer close(responseChan)
-
-	if err := c.performHandshake(); err != nil {
-		responseChan <- fmt.Sprintf("Error: %v", err)
+	format, err := parseResponseFormat(req.ResponseFormat)
+	if err != nil {
+		writeError(w, invalidRequest(err))
 		return
 	}
 
-	if err := c.sendAiRequest(message, model, previousConversations); err != nil {
-		responseChan <- fmt.Sprintf("Error: %v", err)
+	prompt, err := buildPrompt(r.Context(), req.Model, flattenToolMessages(req.Messages))
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-
-	c.processResponses(ctx, responseChan)
-}
-
-func (c *Client) performHandshake() error {
-	if err := c.waitForMessage("send_hash"); err != nil {
-		return fmt.Errorf("waiting for send_hash: %w", err)
+	if tools != "" {
+		prompt.SystemPrompt += "\n\n" + tools
 	}
-
-	if err := c.sendJSON(map[string]interface{}{
-		"fn_index":     fnindex,
-		"session_hash": c.sessionHash,
-	}); err != nil {
-		return fmt.Errorf("sending session hash: %w", err)
+	if format != nil {
+		prompt.SystemPrompt += "\n\n" + format.instructions()
 	}
 
-	if err := c.waitForMessage("estimation"); err != nil {
-		return fmt.Errorf("waiting for estimation: %w", err)
+	n := req.N
+	if n <= 0 {
+		n = 1
 	}
-
-	if err := c.waitForMessage("send_data"); err != nil {
-		return fmt.Errorf("waiting for send_data: %w", err)
+	if n > maxChoices {
+		writeError(w, invalidRequestf("n must be at most %d", maxChoices))
+		return
 	}
 
-	return nil
-}
-
-func (c *Client) sendAiRequest(message string, model string, previousConversations [][]string) error {
-	req := map[string]interface{}{
-		"data": []interface{}{
-			nil, 4096, model, message, "", 1, 1, previousConversations,
-			nil, "Serve me as a writing and programming assistant.", "", nil,
-		},
-		"event_data":   nil,
-		"fn_index":     fnindex,
-		"session_hash": c.sessionHash,
+	if err := upstreamAvailable(); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	return c.sendJSON(req)
-}
+	// Every choice is an upstream session of its own; all of them end when
+	// the HTTP client goes away.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
 
-func (c *Client) processResponses(ctx context.Context, responseChan chan<- string) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-c.receiveChan:
-			var response def.AiResponse
-			if err := json.Unmarshal(msg, &response); err != nil {
-				responseChan <- fmt.Sprintf("Error unmarshalling response: %v", err)
-				return
-			}
+	lim := limits{stops: req.Stop, maxTokens: req.MaxOutputTokens()}
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
 
-			switch response.Msg {
-			case "process_starts":
-				// Process has started, wait for generating messages
-			case "process_generating", "process_completed":
-				if !response.Success {
-					responseChan <- fmt.Sprintf("Error from server: %v", response.Output)
-					return
-				}
-				if latestResponse := c.extractLatestResponse(response); latestResponse != "" {
-					responseChan <- latestResponse
-				}
-				if response.Msg == "process_completed" {
-					return
-				}
-			default:
-				log.Printf("Unexpected message type: %s", response.Msg)
-			}
+	// Tool calls and JSON output can only be recognised once the whole answer
+	// is known, so those cases are buffered like a non-streaming request.
+	if !req.Stream || tools != "" || format != nil {
+		results, usage, err := runChoices(ctx, n, prompt, lim, tools != "", format)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		setAttempts(w, maxAttempts(results))
+		if req.Stream {
+			writeBufferedStream(w, req.Model, results, usage, includeUsage)
+			return
 		}
+		writeCompletion(w, req.Model, results, usage)
+		return
 	}
-}
 
-func (c *Client) extractLatestResponse(response def.AiResponse) string {
-	if len(response.Output.Data) <= 1 {
-		return ""
+	events := make(chan choiceEvent)
+	choices := startChoices(ctx)
+	defer choices.stop()
+	for i := 0; i < n; i++ {
+		choices.stream(i, prompt, lim, events)
+	}
+	ev, ok := firstEvent(ctx, events)
+	if !ok {
+		return
+	}
+	if ev.err != nil {
+		writeError(w, ev.err)
+		return
 	}
 
-	conversations, ok := response.Output.Data[1].([]interface{})
-	if !ok || len(conversations) == 0 {
-		return ""
+	setAttempts(w, ev.attempts)
+	attempts := ev.attempts
+	defer func() { setFinalAttempts(w, attempts) }()
+	cw, ok := newChunkWriter(w, req.Model)
+	if !ok {
+		writeError(w, errStreamingUnsupported)
+		return
+	}
+	for i := 0; i < n; i++ {
+		cw.send(def.OpenAIChatChoice{Index: i, Delta: def.OpenAIChatDelta{Role: "assistant"}})
 	}
+	queue := newQueueReporter(w, cw.flusher, r)
 
-	var latestResponse string
-	if len(conversations) == 1 {
-		conversation := conversations[0].([]interface{})
-		if len(conversation) > 1 {
-			latestResponse = conversation[1].(string)
+	usage := def.OpenAIUsage{PromptTokens: promptTokens(prompt)}
+	for remaining := n; ; {
+		attempts = max(attempts, ev.attempts)
+		if ev.err != nil {
+			writeStreamError(w, cw.flusher, ev.err)
+			return
+		}
+		if ev.queued != nil {
+			queue.report(ev.index, *ev.queued)
 		}
-	} else {
-		latestConversation := conversations[len(conversations)-1].([]interface{})
-		if len(latestConversation) > 1 {
-			latestResponse = latestConversation[1].(string)
+		if ev.delta != "" {
+			cw.send(def.OpenAIChatChoice{Index: ev.index, Delta: def.OpenAIChatDelta{Content: ev.delta}})
+		}
+		if ev.finishReason != "" {
+			cw.finish(ev.index, ev.finishReason)
+			usage.CompletionTokens += ev.tokens
+			if remaining--; remaining == 0 {
+				break
+			}
+		}
+		if ev, ok = nextEvent(ctx, events); !ok {
+			return
 		}
 	}
-
-	return latestResponse
+	if includeUsage {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		cw.usage(usage)
+	}
+	cw.done()
 }
 
-func (c *Client) waitForMessage(expectedMsg string) error {
-	select {
-	case msg := <-c.receiveChan:
-		var response def.AiResponse
-		if err := json.Unmarshal(msg, &response); err != nil {
-			return fmt.Errorf("unmarshalling response: %w", err)
-		}
-		if response.Msg != expectedMsg {
-			return fmt.Errorf("unexpected message: expected %s, got %s", expectedMsg, response.Msg)
+// writeBufferedStream sends already complete answers as a chunk stream.
+func writeBufferedStream(w http.ResponseWriter, model string, results []choiceResult, usage def.OpenAIUsage, includeUsage bool) {
+	cw, ok := newChunkWriter(w, model)
+	if !ok {
+		writeError(w, errStreamingUnsupported)
+		return
+	}
+	for i, result := range results {
+		delta := def.OpenAIChatDelta{Role: "assistant", Content: result.text}
+		for j := range result.calls {
+			call, index := result.calls[j], j
+			call.Index = &index
+			delta.ToolCalls = append(delta.ToolCalls, call)
 		}
-		return nil
-	case <-time.After(waitTimeout):
-		return errors.New("timeout waiting for server message")
+		cw.send(def.OpenAIChatChoice{Index: i, Delta: delta})
+		cw.finish(i, result.finishReason)
+	}
+	if includeUsage {
+		cw.usage(usage)
 	}
+	cw.done()
 }
 
-func (c *Client) sendJSON(v interface{}) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	marshal, err := json.Marshal(v)
-	if err != nil {
-		return err
-	}
-	//	log.Printf("Sending: %s", marshal)
-	//	return c.conn.WriteMessage(websocket.TextMessage, marshal)
-	//	//return c.conn.WriteJSON(v)
-	//}
-	log.Printf("Sending: %s", marshal)
-	return c.conn.WriteMessage(websocket.TextMessage, marshal)
-	//return c.conn.WriteJSON(v)
+func writeCompletion(w http.ResponseWriter, model string, results []choiceResult, usage def.OpenAIUsage) {
+	completion := def.OpenAIChatCompletion{
+		ID:      newCompletionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []def.OpenAIChatCompletionChoice{},
+		Usage:   usage,
+	}
+	for i, result := range results {
+		completion.Choices = append(completion.Choices, def.OpenAIChatCompletionChoice{
+			Index: i,
+			Message: def.OpenAIChatMessage{
+				Role:      "assistant",
+				Content:   result.text,
+				ToolCalls: result.calls,
+			},
+			FinishReason: result.finishReason,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(completion)
 }
 
-func (c *Client) readPump() {
-	defer func() {
-		c.conn.Close()
-		c.isConnected = false
-	}()
-
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
-
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
-		}
-		c.receiveChan <- message
-	}
+// Prompt is the input of one upstream chat exchange.
+type Prompt struct {
+	Message      string
+	Model        string
+	History      [][]string
+	SystemPrompt string
 }
 
-func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.sendChan:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+var errNoUserMessage = invalidRequest(errors.New("messages must contain a user message"))
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
+// buildPrompt turns chat messages into an upstream prompt. The images of the
+// last user message are uploaded to the upstream.
+func buildPrompt(ctx context.Context, model string, messages []def.OpenAIChatMessage) (Prompt, error) {
+	// Extract the user message and previous conversations
+	var userMessage string
+	var previousConversations [][]string
+	_, span := tracer.Start(ctx, "extract conversation", trace.WithAttributes(attribute.Int("messages", len(messages))))
+	previousConversations = s2s.ExtractConversations(messages)
+	span.End()
+	if len(previousConversations) == 0 {
+		return Prompt{}, errNoUserMessage
+	}
+	userMessage = previousConversations[len(previousConversations)-1][0]
+	previousConversations = previousConversations[:len(previousConversations)-1]
+	//每次从req.Messages中提取用户消息和之前的对话，role为user、assistant为一对，system则跳过，如果user后面跟着又是user则说明没有回答，则user自成一对
 
-			if err := w.Close(); err != nil {
-				return
-			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
+	if images := lastUserImages(messages); len(images) > 0 {
+		paths, err := uploadImages(ctx, upstreamAddr, images)
+		if err != nil {
+			return Prompt{}, err
 		}
+		userMessage = appendImageRefs(userMessage, paths)
 	}
-}
 
-func stripHTML(input string) string {
-	//return input
-	re := regexp.MustCompile(`<.*?>`)
-	return re.ReplaceAllString(input, "")
+	return Prompt{
+		Message:      userMessage,
+		Model:        model,
+		History:      previousConversations,
+		SystemPrompt: defaultSystemPrompt,
+	}, nil
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"nixiang-gpt/def"
+
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// handleMessages serves the Anthropic Messages API on top of the same
+// upstream session and conversion as handleChatCompletions.
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	var req def.AnthropicMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, invalidRequest(err))
+		return
+	}
+	setRequestModel(r.Context(), req.Model)
+	if req.MaxTokens <= 0 {
+		writeAnthropicError(w, invalidRequestf("max_tokens must be greater than 0"))
+		return
+	}
+	messages, err := anthropicToOpenAI(req.Messages)
+	if err != nil {
+		writeAnthropicError(w, invalidRequest(err))
+		return
+	}
+	if err := checkImageSupport(req.Model, messages); err != nil {
+		writeAnthropicError(w, invalidRequest(err))
+		return
+	}
+	prompt, err := buildPrompt(r.Context(), req.Model, messages)
+	if err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+	if system := req.System.Text(); system != "" {
+		prompt.SystemPrompt = system
+	}
+	if err := upstreamAvailable(); err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	lim := limits{stops: req.StopSequences, maxTokens: req.MaxTokens}
+	response := def.AnthropicMessagesResponse{
+		ID:      "msg_" + shortuuid.New(),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   req.Model,
+		Content: []def.AnthropicContentBlock{},
+		Usage:   def.AnthropicUsage{InputTokens: promptTokens(prompt)},
+	}
+
+	if !req.Stream {
+		res, err := runPrompt(ctx, prompt, lim)
+		if err != nil {
+			writeAnthropicError(w, err)
+			return
+		}
+		response.Content = append(response.Content, def.AnthropicContentBlock{Type: "text", Text: res.text})
+		response.StopReason, response.StopSequence = anthropicStopReason(res.finishReason, res.stopSequence)
+		response.Usage.OutputTokens = res.tokens
+		setAttempts(w, res.attempts)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	events := make(chan choiceEvent)
+	choices := startChoices(ctx)
+	defer choices.stop()
+	choices.stream(0, prompt, lim, events)
+	ev, ok := firstEvent(ctx, events)
+	if !ok {
+		return
+	}
+	if ev.err != nil {
+		writeAnthropicError(w, ev.err)
+		return
+	}
+
+	setAttempts(w, ev.attempts)
+	attempts := ev.attempts
+	defer func() { setFinalAttempts(w, attempts) }()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, errStreamingUnsupported)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	send := func(event interface{}, name string) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		flusher.Flush()
+	}
+	queue := newQueueReporter(w, flusher, r)
+
+	index := 0
+	send(def.AnthropicStreamEvent{Type: "message_start", Message: &response}, "message_start")
+	send(def.AnthropicStreamEvent{
+		Type:         "content_block_start",
+		Index:        &index,
+		ContentBlock: &def.AnthropicContentBlock{Type: "text"},
+	}, "content_block_start")
+
+	for {
+		attempts = max(attempts, ev.attempts)
+		if ev.err != nil {
+			send(anthropicError(ev.err), "error")
+			return
+		}
+		if ev.queued != nil {
+			queue.report(0, *ev.queued)
+		}
+		if ev.delta != "" {
+			send(def.AnthropicStreamEvent{
+				Type:  "content_block_delta",
+				Index: &index,
+				Delta: &def.AnthropicStreamDelta{Type: "text_delta", Text: ev.delta},
+			}, "content_block_delta")
+		}
+		if ev.finishReason != "" {
+			stopReason, stopSequence := anthropicStopReason(ev.finishReason, ev.stopSequence)
+			send(def.AnthropicStreamEvent{Type: "content_block_stop", Index: &index}, "content_block_stop")
+			send(def.AnthropicStreamEvent{
+				Type:  "message_delta",
+				Delta: &def.AnthropicStreamDelta{StopReason: stopReason, StopSequence: stopSequence},
+				Usage: &def.AnthropicDeltaUsage{OutputTokens: ev.tokens},
+			}, "message_delta")
+			send(def.AnthropicStreamEvent{Type: "message_stop"}, "message_stop")
+			return
+		}
+		if ev, ok = nextEvent(ctx, events); !ok {
+			return
+		}
+	}
+}
+
+// anthropicError renders err in the Anthropic error format.
+func anthropicError(err error) def.AnthropicErrorResponse {
+	e := toAPIError(err)
+	typ := e.typ
+	switch {
+	case e.status == http.StatusGatewayTimeout:
+		typ = "timeout_error"
+	case e.status == http.StatusRequestEntityTooLarge:
+		typ = "request_too_large"
+	case typ != "invalid_request_error":
+		typ = "api_error"
+	}
+	return def.AnthropicErrorResponse{
+		Type:  "error",
+		Error: def.AnthropicError{Type: typ, Message: e.message},
+	}
+}
+
+func writeAnthropicError(w http.ResponseWriter, err error) {
+	setAttempts(w, toAPIError(err).attempts)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(toAPIError(err).status)
+	json.NewEncoder(w).Encode(anthropicError(err))
+}
+
+// anthropicToOpenAI converts Anthropic messages into the OpenAI shape that
+// buildPrompt understands.
+func anthropicToOpenAI(messages []def.AnthropicMessage) ([]def.OpenAIChatMessage, error) {
+	var out []def.OpenAIChatMessage
+	for _, m := range messages {
+		msg := def.OpenAIChatMessage{Role: m.Role, Content: m.Content.Text()}
+		for _, block := range m.Content {
+			switch block.Type {
+			case "text":
+			case "image":
+				if block.Source == nil {
+					return nil, errors.New("image block without source")
+				}
+				switch block.Source.Type {
+				case "base64":
+					msg.Images = append(msg.Images, def.OpenAIImageURL{
+						URL: fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data),
+					})
+				case "url":
+					msg.Images = append(msg.Images, def.OpenAIImageURL{URL: block.Source.URL})
+				default:
+					return nil, fmt.Errorf("unsupported image source type %q", block.Source.Type)
+				}
+			default:
+				return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+			}
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// anthropicStopReason maps a finish reason onto stop_reason and stop_sequence.
+func anthropicStopReason(finishReason, stopSequence string) (*string, *string) {
+	reason := "end_turn"
+	switch {
+	case finishReason == "length":
+		reason = "max_tokens"
+	case stopSequence != "":
+		reason = "stop_sequence"
+		return &reason, &stopSequence
+	}
+	return &reason, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicToOpenAI(t *testing.T) {
+	var req def.AnthropicMessagesRequest
+	err := json.Unmarshal([]byte(`{
+		"model": "gpt-4o",
+		"max_tokens": 100,
+		"system": [{"type": "text", "text": "be brief"}],
+		"messages": [
+			{"role": "user", "content": "你好"},
+			{"role": "assistant", "content": "你好！"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "what is this?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}}
+			]}
+		]
+	}`), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.System.Text() != "be brief" {
+		t.Errorf("system: got %q", req.System.Text())
+	}
+	messages, err := anthropicToOpenAI(req.Messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].Content != "你好" || messages[1].Role != "assistant" {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if messages[2].Content != "what is this?" || len(messages[2].Images) != 1 ||
+		messages[2].Images[0].URL != "data:image/png;base64,AAAA" {
+		t.Errorf("multimodal message: got %+v", messages[2])
+	}
+
+	_, err = anthropicToOpenAI([]def.AnthropicMessage{{
+		Role:    "user",
+		Content: def.AnthropicContent{{Type: "tool_use"}},
+	}})
+	if err == nil {
+		t.Error("expected an error for tool_use blocks")
+	}
+}
+
+func TestAnthropicStopReason(t *testing.T) {
+	cases := []struct {
+		finishReason, stopSequence string
+		reason, sequence           string
+	}{
+		{"stop", "", "end_turn", ""},
+		{"stop", "###", "stop_sequence", "###"},
+		{"length", "", "max_tokens", ""},
+	}
+	for _, c := range cases {
+		reason, sequence := anthropicStopReason(c.finishReason, c.stopSequence)
+		got := ""
+		if sequence != nil {
+			got = *sequence
+		}
+		if *reason != c.reason || got != c.sequence {
+			t.Errorf("%q/%q: got %q/%q", c.finishReason, c.stopSequence, *reason, got)
+		}
+	}
+}
+
+func TestMessagesStream(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello, wor", "Hello, world!")
+	rec := httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{
+		"model": "gpt-4o", "max_tokens": 100, "stream": true, "stop_sequences": ["wor"],
+		"messages": [{"role": "user", "content": "Say hello"}]}`)))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var names []string
+	var text strings.Builder
+	var delta def.AnthropicStreamEvent
+	var deltaData string
+	for _, frame := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n") {
+		name, data, _ := strings.Cut(frame, "\ndata: ")
+		name = strings.TrimPrefix(name, "event: ")
+		var ev def.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("event %q: %v", frame, err)
+		}
+		if ev.Type != name {
+			t.Errorf("event %s has type %q", name, ev.Type)
+		}
+		// Consecutive deltas count as one step of the sequence.
+		if name != "content_block_delta" || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+		switch name {
+		case "content_block_delta":
+			text.WriteString(ev.Delta.Text)
+		case "message_delta":
+			delta, deltaData = ev, data
+		}
+	}
+	want := []string{"message_start", "content_block_start", "content_block_delta",
+		"content_block_stop", "message_delta", "message_stop"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("events %q, want %q", names, want)
+	}
+	if text.String() != "Hello, " {
+		t.Errorf("text %q", text.String())
+	}
+	if delta.Delta == nil || delta.Delta.StopReason == nil || *delta.Delta.StopReason != "stop_sequence" ||
+		delta.Delta.StopSequence == nil || *delta.Delta.StopSequence != "wor" {
+		t.Errorf("message_delta = %s", deltaData)
+	}
+	if delta.Usage == nil || delta.Usage.OutputTokens == 0 || strings.Contains(deltaData, "input_tokens") {
+		t.Errorf("message_delta usage = %s", deltaData)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeUpstream points the handlers at a fake upstream for the duration of
+// the test, with short timeouts and fast retries.
+func useFakeUpstream(t *testing.T, answer ...string) *fakeGradio {
+	f := newFakeGradio(t, answer...)
+	addr, warm, timeout, retry := upstreamAddr, warmConnections, waitTimeout, upstreamRetry
+	t.Cleanup(func() {
+		upstreamAddr, warmConnections, waitTimeout, upstreamRetry = addr, warm, timeout, retry
+	})
+	upstreamAddr = f.addr()
+	// Warm connections would take the scripted sessions out of order.
+	warmConnections = 0
+	waitTimeout = 200 * time.Millisecond
+	upstreamRetry = retryPolicy{attempts: 2, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+	return f
+}
+
+func postChat(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleChatCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	return rec
+}
+
+// sseData returns the data of every event of an SSE body.
+func sseData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return data
+}
+
+func TestChatCompletion(t *testing.T) {
+	f := useFakeUpstream(t, "Hel", "Hello, wor", "Hello, world!")
+	rec := postChat(t, `{"model":"gpt-4o","messages":[
+		{"role":"system","content":"Be brief."},
+		{"role":"user","content":"Hi"},
+		{"role":"assistant","content":"Hi there"},
+		{"role":"user","content":"Say hello"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var completion def.OpenAIChatCompletion
+	if err := json.Unmarshal(rec.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "Hello, world!" ||
+		completion.Choices[0].FinishReason != "stop" {
+		t.Errorf("unexpected completion %s", rec.Body)
+	}
+	if got := rec.Header().Get(attemptsHeader); got != "1" {
+		t.Errorf("%s = %q, want 1", attemptsHeader, got)
+	}
+
+	reqs := f.received()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream received %d requests", len(reqs))
+	}
+	if reqs[0].Data[2] != "gpt-4o" || reqs[0].Data[3] != "Say hello" {
+		t.Errorf("upstream request data = %v", reqs[0].Data)
+	}
+	history, _ := json.Marshal(reqs[0].Data[7])
+	if string(history) != `[["Hi","Hi there"]]` {
+		t.Errorf("upstream history = %s", history)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello, wor", "Hello, world!")
+	rec := postChat(t, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Say hello"}]}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	data := sseData(rec.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("stream does not end with [DONE]: %q", data)
+	}
+	var content strings.Builder
+	var finishReasons []string
+	for _, d := range data[:len(data)-1] {
+		var chunk def.OpenAIChatResponse
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("chunk %s: %v", d, err)
+		}
+		for _, c := range chunk.Choices {
+			content.WriteString(c.Delta.Content)
+			if c.FinishReason != nil {
+				finishReasons = append(finishReasons, *c.FinishReason)
+			}
+		}
+	}
+	if content.String() != "Hello, world!" || !reflect.DeepEqual(finishReasons, []string{"stop"}) {
+		t.Errorf("content %q, finish reasons %q", content.String(), finishReasons)
+	}
+}
+
+func TestChatCompletionRetry(t *testing.T) {
+	f := useFakeUpstream(t, "Hello")
+	f.fail(fakeQueueFull)
+	rec := postChat(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"content":"Hello"`) {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get(attemptsHeader); got != "2" {
+		t.Errorf("%s = %q, want 2", attemptsHeader, got)
+	}
+}
+
+func TestChatCompletionUpstreamErrors(t *testing.T) {
+	cases := []struct {
+		failure  fakeFailure
+		status   int
+		code     string
+		attempts string
+	}{
+		{fakeQueueFull, http.StatusServiceUnavailable, "upstream_queue_full", "2"},
+		{fakeSilent, http.StatusGatewayTimeout, "upstream_timeout", "2"},
+		// The upstream failed the request itself, which would fail again.
+		{fakeUnsuccessful, http.StatusBadGateway, "upstream_failed", "1"},
+		{fakeOverloaded, http.StatusBadGateway, "upstream_failed", "2"},
+		// Output had been produced, so the session is not retried.
+		{fakeDisconnect, http.StatusBadGateway, "upstream_failed", "1"},
+	}
+	for _, c := range cases {
+		f := useFakeUpstream(t, "Hel", "Hello")
+		f.fail(c.failure, c.failure)
+		for _, stream := range []string{"false", "true"} {
+			if stream == "true" {
+				f.fail(c.failure, c.failure)
+				// Four failures in a row would have opened the breaker.
+				health.Delete(upstreamAddr)
+			}
+			rec := postChat(t, `{"model":"gpt-4o","stream":`+stream+`,"messages":[{"role":"user","content":"Hi"}]}`)
+			if c.failure == fakeDisconnect && stream == "true" {
+				// Output has been sent, so the error ends the stream.
+				data := sseData(rec.Body.String())
+				if rec.Code != http.StatusOK || len(data) == 0 || !strings.Contains(data[len(data)-1], `"code":"upstream_failed"`) {
+					t.Errorf("disconnect while streaming: %d %q", rec.Code, data)
+				}
+				continue
+			}
+			var resp def.OpenAIErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != c.status || resp.Error.Code != c.code {
+				t.Errorf("failure %d, stream %s: %d %s, want %d %s", c.failure, stream, rec.Code, resp.Error.Code, c.status, c.code)
+			}
+			if got := rec.Header().Get(attemptsHeader); got != c.attempts {
+				t.Errorf("failure %d, stream %s: %s = %q, want %s", c.failure, stream, attemptsHeader, got, c.attempts)
+			}
+		}
+	}
+}
+
+func TestChatCompletionStreamAttemptsTrailer(t *testing.T) {
+	f := useFakeUpstream(t, "Hello")
+	// The first session fails after the queue position started the stream.
+	shortenQueueHeartbeat(t, 10*time.Millisecond)
+	f.queueDelay = 50 * time.Millisecond
+	f.fail(fakeOverloaded)
+	rec := postChat(t, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"content":"Hello"`) {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	resp := rec.Result()
+	if got := resp.Header.Get(attemptsHeader); got != "1" {
+		t.Errorf("%s header = %q, want 1", attemptsHeader, got)
+	}
+	if got := resp.Trailer.Get(attemptsHeader); got != "2" {
+		t.Errorf("%s trailer = %q, want 2", attemptsHeader, got)
+	}
+}
+
+// shortenQueueHeartbeat sets queueHeartbeat for the duration of the test.
+func shortenQueueHeartbeat(t *testing.T, d time.Duration) {
+	heartbeat := queueHeartbeat
+	t.Cleanup(func() { queueHeartbeat = heartbeat })
+	queueHeartbeat = d
+}
+
+func TestChatCompletionStreamQueued(t *testing.T) {
+	f := useFakeUpstream(t, "Hello")
+	f.rank = 2
+	post := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+		r.Header.Set("X-Queue-Status", "events")
+		handleChatCompletions(rec, r)
+		return rec
+	}
+
+	// A short wait in the queue is not reported.
+	rec := post()
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "queue_status") {
+		t.Errorf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// A long one is, before the answer.
+	shortenQueueHeartbeat(t, 10*time.Millisecond)
+	f.queueDelay = 50 * time.Millisecond
+	rec = post()
+	body := rec.Body.String()
+	status, answer := strings.Index(body, "event: queue_status"), strings.Index(body, `"content":"Hello"`)
+	if rec.Code != http.StatusOK || status < 0 || answer < status || !strings.Contains(body, `"position":3`) {
+		t.Errorf("status = %d: %s", rec.Code, body)
+	}
+}
+
+func TestChatCompletionStreamQueuedFailure(t *testing.T) {
+	// A session that fails after a short wait in the queue still gets an
+	// error status, as the headers have not been sent yet.
+	f := useFakeUpstream(t)
+	f.rank = 2
+	f.fail(fakeUnsuccessful)
+	rec := postChat(t, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "upstream_failed") {
+		t.Errorf("status = %d: %s", rec.Code, rec.Body)
+	}
+}
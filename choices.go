@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nixiang-gpt/def"
+	"nixiang-gpt/event"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errInvalidJSON = errors.New("upstream did not produce valid JSON")
+
+// choiceResult is a complete answer ready to be written out.
+type choiceResult struct {
+	text         string
+	calls        []def.OpenAIToolCall
+	finishReason string
+	attempts     int
+}
+
+// maxAttempts returns the highest number of upstream sessions a choice needed.
+func maxAttempts(results []choiceResult) int {
+	attempts := 0
+	for _, r := range results {
+		if r.attempts > attempts {
+			attempts = r.attempts
+		}
+	}
+	return attempts
+}
+
+// runChoices produces n complete answers from parallel upstream sessions and
+// merges their usage.
+func runChoices(ctx context.Context, n int, prompt Prompt, lim limits, tools bool, format *jsonFormat) ([]choiceResult, def.OpenAIUsage, error) {
+	results := make([]choiceResult, n)
+	usages := make([]def.OpenAIUsage, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], usages[i], errs[i] = runChoice(ctx, prompt, lim, tools, format)
+		}(i)
+	}
+	wg.Wait()
+
+	usage := def.OpenAIUsage{PromptTokens: promptTokens(prompt)}
+	for i := range results {
+		if errs[i] != nil {
+			return nil, usage, errs[i]
+		}
+		usage.PromptTokens += usages[i].PromptTokens
+		usage.CompletionTokens += usages[i].CompletionTokens
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return results, usage, nil
+}
+
+// runChoice produces one complete answer, parsing tool calls and enforcing the
+// JSON format. The usage it returns only counts prompts beyond the original
+// one, i.e. the JSON correction round.
+func runChoice(ctx context.Context, prompt Prompt, lim limits, tools bool, format *jsonFormat) (choiceResult, def.OpenAIUsage, error) {
+	var usage def.OpenAIUsage
+	res, err := runPrompt(ctx, prompt, lim)
+	if err != nil {
+		return choiceResult{}, usage, err
+	}
+	usage.CompletionTokens = res.tokens
+	result := choiceResult{text: res.text, finishReason: res.finishReason, attempts: res.attempts}
+	if tools {
+		result.text, result.calls = parseToolCalls(result.text)
+	}
+	if format != nil && len(result.calls) == 0 && res.finishReason != "length" {
+		doc, err := format.check(res.text)
+		if err != nil {
+			conversionErrors.WithLabelValues(conversionJSON).Inc()
+			// Give the model one chance to fix its answer.
+			retry := prompt
+			retry.History = append(append([][]string{}, prompt.History...), []string{prompt.Message, res.text})
+			retry.Message = format.retryMessage(err)
+			usage.PromptTokens += promptTokens(retry)
+			if res, err = runPrompt(ctx, retry, lim); err == nil {
+				usage.CompletionTokens += res.tokens
+				result.finishReason = res.finishReason
+				if res.attempts > result.attempts {
+					result.attempts = res.attempts
+				}
+				if doc, err = format.check(res.text); err != nil {
+					conversionErrors.WithLabelValues(conversionJSON).Inc()
+				}
+			}
+		}
+		if err != nil {
+			return choiceResult{}, usage, upstreamFailure(fmt.Errorf("%w: %v", errInvalidJSON, err))
+		}
+		result.text = doc
+	}
+	if len(result.calls) > 0 {
+		result.finishReason = "tool_calls"
+	}
+	return result, usage, nil
+}
+
+// choiceEvent is a delta of one streamed choice. The last event of a choice
+// carries its finish reason and completion token count, or the error that
+// ended it. While the choice waits in the upstream queue, events carry only
+// the queue position. Every event carries the number of upstream sessions
+// the choice has needed so far.
+type choiceEvent struct {
+	index        int
+	delta        string
+	finishReason string
+	stopSequence string
+	tokens       int
+	queued       *event.Queued
+	attempts     int
+	err          error
+}
+
+// choiceGroup runs the streamed choices of a request. The request waits for
+// them before it ends, so that their sessions are closed and their spans and
+// outcomes recorded within the request.
+type choiceGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startChoices(ctx context.Context) *choiceGroup {
+	g := &choiceGroup{}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	return g
+}
+
+// sessionSet tracks the streamed choices of all requests, which shutdown
+// waits for to close their upstream connections. Once shutdown waits, it
+// refuses new ones.
+type sessionSet struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	// idle is closed once the set is closed and empty.
+	idle chan struct{}
+}
+
+var sessions = &sessionSet{}
+
+// add records a new session, unless the set is closed.
+func (s *sessionSet) add() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.n++
+	return true
+}
+
+func (s *sessionSet) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n--
+	if s.closed && s.n == 0 {
+		close(s.idle)
+	}
+}
+
+// close refuses new sessions and returns a channel that is closed once the
+// running ones are done.
+func (s *sessionSet) close() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.idle = make(chan struct{})
+		if s.n == 0 {
+			close(s.idle)
+		}
+	}
+	return s.idle
+}
+
+// stream starts streaming a choice into events, as streamChoice. Once the
+// server is shutting down, the choice fails with errShuttingDown instead.
+func (g *choiceGroup) stream(index int, prompt Prompt, lim limits, events chan<- choiceEvent) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if !sessions.add() {
+			select {
+			case events <- choiceEvent{index: index, err: errShuttingDown}:
+			case <-g.ctx.Done():
+			}
+			return
+		}
+		defer sessions.done()
+		streamChoice(g.ctx, index, prompt, lim, events)
+	}()
+}
+
+// stop cancels the choices that are still running and waits for all of them
+// to end.
+func (g *choiceGroup) stop() {
+	g.cancel()
+	g.wg.Wait()
+}
+
+// streamChoice pumps the answer of an upstream session into events. Sessions
+// that fail before any output has been emitted are retried as upstreamRetry
+// allows.
+func streamChoice(ctx context.Context, index int, prompt Prompt, lim limits, events chan<- choiceEvent) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	firstToken := true
+	attempt := 1
+	upstream := healthOf(upstreamAddr)
+	emit := func(ev choiceEvent) bool {
+		ev.index = index
+		ev.attempts = attempt
+		if ev.queued != nil {
+			upstream.queued(ev.queued.QueueSize)
+		}
+		if firstToken && ev.delta != "" {
+			firstToken = false
+			timeToFirstToken.WithLabelValues(modelLabel(prompt.Model)).Observe(time.Since(start).Seconds())
+		}
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ; ; attempt++ {
+		_, span := tracer.Start(ctx, "upstream dial", trace.WithAttributes(
+			attribute.String("upstream.host", hostLabel(upstreamAddr)),
+			attribute.Int("upstream.attempt", attempt),
+		))
+		client, err := NewClient(upstreamAddr)
+		endSpan(span, err)
+		sent := false
+		if err != nil {
+			upstreamHandshakeFailures.WithLabelValues(hostLabel(upstreamAddr)).Inc()
+		} else {
+			sent, err = streamSession(ctx, client, prompt, lim, emit)
+			client.Close()
+		}
+		// A session cut short by the caller says nothing about the upstream,
+		// and one the upstream failed for good shows that it is up.
+		switch {
+		case err != nil && ctx.Err() != nil:
+		case errors.Is(err, errUpstreamFailed) && !retryable(err):
+			upstream.observe(nil)
+		default:
+			upstream.observe(err)
+		}
+		if err == nil {
+			return
+		}
+		if sent || attempt >= upstreamRetry.attempts || !retryable(err) {
+			e := *upstreamFailure(err)
+			e.attempts = attempt
+			emit(choiceEvent{err: &e})
+			return
+		}
+		logger(ctx).Warn("upstream session failed, retrying", "attempt", attempt, "error", err)
+		select {
+		case <-time.After(upstreamRetry.delay(attempt)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// streamSession runs one upstream session. It returns the error that ended
+// the session, if any, and whether output had been emitted by then.
+func streamSession(ctx context.Context, client *Client, prompt Prompt, lim limits, emit func(choiceEvent) bool) (sent bool, err error) {
+	ctx, span := tracer.Start(ctx, "upstream session", trace.WithAttributes(
+		attribute.String("upstream.session", client.sessionHash),
+		attribute.String("model", prompt.Model),
+	))
+	// Converting the deltas is interleaved with generating, so their total
+	// conversion time is recorded on the session; only the final conversion
+	// has a span of its own.
+	var converting time.Duration
+	convert := func(f func()) {
+		start := time.Now()
+		f()
+		converting += time.Since(start)
+	}
+	defer func() {
+		span.SetAttributes(attribute.Int64("conversion.duration_us", converting.Microseconds()))
+		endSpan(span, err)
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	upstream, err := client.SendMessage(ctx, prompt)
+	if err != nil {
+		return false, err
+	}
+	// The exchange ends once its events are drained, with its spans inside
+	// the session's.
+	defer func() {
+		cancel()
+		for range upstream {
+		}
+	}()
+	// The position is repeated while the queue does not move, which also
+	// keeps streaming clients and proxies in between from timing out.
+	heartbeat := time.NewTicker(queueHeartbeat)
+	defer heartbeat.Stop()
+	var queued *event.Queued
+	var queuedAt time.Time
+	defer func() {
+		if queued != nil {
+			upstreamQueueWaiting.Add(-1)
+		}
+	}()
+
+	ans := newAnswer(lim)
+	for {
+		var ev event.Event
+		select {
+		case e, ok := <-upstream:
+			if !ok {
+				return sent, nil
+			}
+			ev = e
+		case <-heartbeat.C:
+			if queued != nil && !emit(choiceEvent{queued: queued}) {
+				return sent, nil
+			}
+			continue
+		}
+
+		switch ev := ev.(type) {
+		case event.Queued:
+			if queued == nil {
+				upstreamQueueWaiting.Add(1)
+				queuedAt = time.Now()
+				// Gradio ranks from 0, meaning next in line.
+				upstreamQueuePosition.Observe(float64(ev.Rank + 1))
+				upstreamQueueETA.Observe(ev.ETA.Seconds())
+			}
+			queued = &ev
+			upstreamQueueSize.WithLabelValues(hostLabel(client.addr)).Set(float64(ev.QueueSize))
+			if !emit(choiceEvent{queued: queued}) {
+				return sent, nil
+			}
+		case event.Started:
+			if queued != nil {
+				upstreamQueueWaiting.Add(-1)
+				upstreamQueueWait.Observe(time.Since(queuedAt).Seconds())
+				queued = nil
+			}
+		case event.Delta:
+			var delta, finishReason string
+			convert(func() { delta, finishReason = ans.push(ev.HTML) })
+			if finishReason != "" {
+				// Returning aborts the upstream session, the rest is not needed.
+				emit(choiceEvent{delta: delta, finishReason: finishReason, stopSequence: ans.stopSequence(), tokens: ans.tokens()})
+				return true, nil
+			}
+			if delta != "" {
+				sent = true
+				if !emit(choiceEvent{delta: delta}) {
+					return sent, nil
+				}
+			}
+		case event.Completed:
+			var delta, finishReason string
+			_, conv := tracer.Start(ctx, "conversion")
+			convert(func() {
+				delta, finishReason = ans.push(ev.Final)
+				if finishReason == "" {
+					var rest string
+					rest, finishReason = ans.flush()
+					delta += rest
+				}
+			})
+			conv.End()
+			emit(choiceEvent{delta: delta, finishReason: finishReason, stopSequence: ans.stopSequence(), tokens: ans.tokens()})
+			return true, nil
+		case event.Failed:
+			return sent, ev.Err
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nixiang-gpt/def"
+	"nixiang-gpt/event"
+	"time"
+
+	"github.com/lithammer/shortuuid/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client runs exchanges with a Gradio queue over the transport matching the
+// upstream's protocol version.
+type Client struct {
+	addr        string
+	sessionHash string
+	t           transport
+	// diffs is set when process_generating carries diffs against the
+	// previous output instead of the whole output.
+	diffs bool
+}
+
+var (
+	errUpstreamTimeout  = errors.New("timeout waiting for server message")
+	errConnectionClosed = errors.New("upstream connection closed")
+	errQueueFull        = errors.New("upstream queue is full")
+	errUpstreamFailed   = errors.New("upstream reported failure")
+)
+
+func NewClient(addr string) (*Client, error) {
+	c := &Client{
+		addr:        addr,
+		sessionHash: shortuuid.New(),
+	}
+
+	proto, err := probeProtocol(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch proto {
+	case protocolSSE:
+		base, err := httpBase(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.t = newSSETransport(base, c.sessionHash)
+		c.diffs = true
+	default:
+		t, err := takeWebsocket(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.t = t
+	}
+	if recordDir != "" {
+		if err := record(c, proto); err != nil {
+			c.t.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close tears down the upstream connection, aborting any running exchange.
+func (c *Client) Close() error {
+	return c.t.Close()
+}
+
+// SendMessage starts an exchange and returns its events. The channel is
+// closed after Completed or Failed, or once ctx is cancelled.
+func (c *Client) SendMessage(ctx context.Context, prompt Prompt) (<-chan event.Event, error) {
+	events := make(chan event.Event)
+
+	go c.handleMessageExchange(ctx, prompt, events)
+
+	return events, nil
+}
+
+func (c *Client) handleMessageExchange(ctx context.Context, prompt Prompt, events chan<- event.Event) {
+	defer close(events)
+
+	emit := func(ev event.Event) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if err := c.exchange(ctx, prompt, emit); err != nil {
+		emit(event.Failed{Err: err})
+	}
+}
+
+// exchangeState is how far an exchange has got through the queue protocol.
+type exchangeState int
+
+const (
+	// stateJoining waits for the server to take the request.
+	stateJoining exchangeState = iota
+	// stateQueued waits for a free worker.
+	stateQueued
+	// stateGenerating receives the answer.
+	stateGenerating
+)
+
+// spanName names the span tracing the state.
+func (s exchangeState) spanName() string {
+	switch s {
+	case stateJoining:
+		return "queue join"
+	case stateQueued:
+		return "queue wait"
+	default:
+		return "generation"
+	}
+}
+
+func (s exchangeState) String() string {
+	switch s {
+	case stateJoining:
+		return "joining queue"
+	case stateQueued:
+		return "queued"
+	default:
+		return "generating"
+	}
+}
+
+// exchange drives one request through the queue protocol. Both protocol
+// versions share the message types; the websocket one additionally has the
+// server ask for the session hash and the data. Messages that do not matter
+// to us, or arrive in an order we did not expect, are tolerated.
+func (c *Client) exchange(ctx context.Context, prompt Prompt, emit func(event.Event) bool) (err error) {
+	upstreamSessions.Inc()
+	// Every state is traced as a span of its own.
+	state := stateJoining
+	phaseCtx, phase := tracer.Start(ctx, state.spanName())
+	enter := func(s exchangeState) {
+		phase.End()
+		state = s
+		phaseCtx, phase = tracer.Start(ctx, s.spanName())
+	}
+	// step traces a handshake message sent in the current state.
+	step := func(name string, v interface{}) error {
+		spanCtx, span := tracer.Start(phaseCtx, name)
+		err := c.t.send(spanCtx, v)
+		endSpan(span, err)
+		return err
+	}
+	defer func() {
+		endSpan(phase, err)
+		upstreamSessions.Dec()
+		if err != nil && state == stateJoining && !errors.Is(err, errQueueFull) {
+			upstreamHandshakeFailures.WithLabelValues(hostLabel(c.addr)).Inc()
+		}
+	}()
+
+	req := c.request(prompt)
+	logger(ctx).Debug("joining upstream queue", "addr", c.addr, "session", c.sessionHash,
+		"model", prompt.Model, "message", redacted(prompt.Message), "history_turns", len(prompt.History))
+	if err := c.t.join(ctx, req); err != nil {
+		return fmt.Errorf("joining queue: %w", err)
+	}
+
+	var output []interface{}
+	var latest string
+	for {
+		// Once queued, waiting is expected; the transports detect dead
+		// connections by themselves.
+		var timeout time.Duration
+		if state == stateJoining {
+			timeout = waitTimeout
+		}
+		frame, err := c.t.receive(ctx, timeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", state, err)
+		}
+		if frame == nil {
+			return nil
+		}
+		var response def.AiResponse
+		if err := json.Unmarshal(frame, &response); err != nil {
+			conversionErrors.WithLabelValues(conversionFrame).Inc()
+			return fmt.Errorf("unmarshalling response: %w", err)
+		}
+
+		switch response.Msg {
+		case "send_hash":
+			if err := step("send_hash", map[string]interface{}{
+				"fn_index":     fnindex,
+				"session_hash": c.sessionHash,
+			}); err != nil {
+				return fmt.Errorf("sending session hash: %w", err)
+			}
+		case "send_data":
+			if err := step("send_data", req); err != nil {
+				return fmt.Errorf("sending request: %w", err)
+			}
+		case "queue_full":
+			return errQueueFull
+		case "estimation":
+			if state == stateJoining {
+				enter(stateQueued)
+			}
+			queued := event.Queued{
+				Rank:      response.Rank,
+				QueueSize: response.QueueSize,
+				ETA:       time.Duration(response.RankEta * float64(time.Second)),
+			}
+			phase.AddEvent("estimation", trace.WithAttributes(
+				attribute.Int("queue.rank", queued.Rank),
+				attribute.Int("queue.size", queued.QueueSize),
+				attribute.Float64("queue.eta_seconds", response.RankEta),
+			))
+			if !emit(queued) {
+				return nil
+			}
+		case "heartbeat", "progress":
+		case "log":
+			logger(ctx).Info("upstream log", "session", c.sessionHash, "message", response.Log)
+		case "process_starts":
+			if state != stateGenerating {
+				enter(stateGenerating)
+				if !emit(event.Started{}) {
+					return nil
+				}
+			}
+		case "process_generating", "process_completed":
+			if !response.Success {
+				if response.Output.Error != nil {
+					return fmt.Errorf("%w: %v", errUpstreamFailed, response.Output.Error)
+				}
+				return errUpstreamFailed
+			}
+			if state != stateGenerating {
+				enter(stateGenerating)
+				if !emit(event.Started{}) {
+					return nil
+				}
+			}
+			data := response.Output.Data
+			if c.diffs && response.Msg == "process_generating" {
+				if data, err = applyOutputDiffs(output, data); err != nil {
+					conversionErrors.WithLabelValues(conversionDiff).Inc()
+					return err
+				}
+			}
+			output = data
+
+			snapshot := extractLatestResponse(output)
+			if snapshot != "" {
+				latest = snapshot
+			}
+			if response.Msg == "process_completed" {
+				emit(event.Completed{Final: latest})
+				return nil
+			}
+			if snapshot != "" && !emit(event.Delta{HTML: snapshot}) {
+				return nil
+			}
+		case "close_stream":
+			return errConnectionClosed
+		case "unexpected_error":
+			return fmt.Errorf("upstream error: %s", response.Message)
+		default:
+			logger(ctx).Debug("unexpected upstream message", "session", c.sessionHash, "msg", response.Msg)
+		}
+	}
+}
+
+func (c *Client) request(prompt Prompt) def.AiRequest {
+	systemPrompt := prompt.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = defaultSystemPrompt
+	}
+	history := prompt.History
+	if history == nil {
+		history = [][]string{}
+	}
+	return def.AiRequest{
+		Data: []interface{}{
+			nil, 4096, prompt.Model, prompt.Message, "", 1, 1, history,
+			nil, systemPrompt, "", nil,
+		},
+		FnIndex:     fnindex,
+		SessionHash: c.sessionHash,
+	}
+}
+
+// extractLatestResponse returns the HTML of the last answer in the chatbot
+// output.
+func extractLatestResponse(data []interface{}) string {
+	if len(data) <= 1 {
+		return ""
+	}
+
+	conversations, ok := data[1].([]interface{})
+	if !ok || len(conversations) == 0 {
+		return ""
+	}
+
+	// The answer is null until the first token arrives.
+	latest, _ := conversations[len(conversations)-1].([]interface{})
+	if len(latest) < 2 {
+		return ""
+	}
+	latestResponse, _ := latest[1].(string)
+	return latestResponse
+}
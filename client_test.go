@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"nixiang-gpt/def"
+	"nixiang-gpt/event"
+)
+
+// scriptedTransport replays server messages and records what is sent.
+type scriptedTransport struct {
+	frames []string
+	joined bool
+	sent   []interface{}
+}
+
+func (t *scriptedTransport) join(ctx context.Context, req def.AiRequest) error {
+	t.joined = true
+	return nil
+}
+
+func (t *scriptedTransport) send(ctx context.Context, v interface{}) error {
+	t.sent = append(t.sent, v)
+	return nil
+}
+
+func (t *scriptedTransport) receive(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if len(t.frames) == 0 {
+		return nil, errConnectionClosed
+	}
+	frame := t.frames[0]
+	t.frames = t.frames[1:]
+	return []byte(frame), nil
+}
+
+func (t *scriptedTransport) Close() error {
+	return nil
+}
+
+// collect runs an exchange and describes its events.
+func collect(t *testing.T, c *Client) []string {
+	t.Helper()
+	events, err := c.SendMessage(context.Background(), Prompt{Message: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for ev := range events {
+		switch ev := ev.(type) {
+		case event.Queued:
+			got = append(got, "queued "+ev.ETA.String())
+		case event.Started:
+			got = append(got, "started")
+		case event.Delta:
+			got = append(got, "delta "+ev.HTML)
+		case event.Completed:
+			got = append(got, "completed "+ev.Final)
+		case event.Failed:
+			got = append(got, "failed "+ev.Err.Error())
+		}
+	}
+	return got
+}
+
+func TestExchangeWebsocket(t *testing.T) {
+	tr := &scriptedTransport{frames: []string{
+		`{"msg":"send_hash"}`,
+		`{"msg":"heartbeat"}`,
+		`{"msg":"estimation","rank":1,"queue_size":2,"rank_eta":1.5}`,
+		`{"msg":"log","log":"warming up"}`,
+		`{"msg":"estimation","rank":0,"queue_size":1,"rank_eta":0.5}`,
+		`{"msg":"send_data"}`,
+		`{"msg":"process_starts"}`,
+		`{"msg":"progress"}`,
+		`{"msg":"process_generating","success":true,"output":{"data":[null,[["hi","Hel"]]]}}`,
+		`{"msg":"process_generating","success":true,"output":{"data":[null,[["hi","Hello"]]]}}`,
+		`{"msg":"process_completed","success":true,"output":{"data":[null,[["hi","Hello!"]]]}}`,
+	}}
+	got := collect(t, &Client{sessionHash: "s", t: tr})
+	want := []string{"queued 1.5s", "queued 500ms", "started", "delta Hel", "delta Hello", "completed Hello!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if len(tr.sent) != 2 {
+		t.Fatalf("sent %d messages, want session hash and data", len(tr.sent))
+	}
+	if _, ok := tr.sent[1].(def.AiRequest); !ok {
+		t.Errorf("second message is %T, want the request", tr.sent[1])
+	}
+}
+
+func TestExchangeSSEDiffs(t *testing.T) {
+	tr := &scriptedTransport{frames: []string{
+		`{"msg":"estimation","rank":0,"queue_size":1,"rank_eta":null}`,
+		`{"msg":"process_generating","success":true,"output":{"data":[[["replace",[],null]],[["replace",[],[["hi",""]]]]]}}`,
+		`{"msg":"process_generating","success":true,"output":{"data":[[],[["append",[0,1],"Hel"]]]}}`,
+		`{"msg":"process_generating","success":true,"output":{"data":[[],[["append",[0,1],"lo"]]]}}`,
+		`{"msg":"heartbeat"}`,
+		`{"msg":"process_completed","success":true,"output":{"data":[null,[["hi","Hello"]]]}}`,
+		`{"msg":"close_stream"}`,
+	}}
+	got := collect(t, &Client{sessionHash: "s", t: tr, diffs: true})
+	// Gradio 4 may skip process_starts; the first diff replaces whole outputs.
+	want := []string{"queued 0s", "started", "delta Hel", "delta Hello", "completed Hello"}
+	if !tr.joined || !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestExchangeFailures(t *testing.T) {
+	cases := []struct {
+		frames []string
+		want   error
+	}{
+		{[]string{`{"msg":"queue_full"}`}, errQueueFull},
+		{[]string{`{"msg":"send_hash"}`, `{"msg":"send_data"}`}, errConnectionClosed},
+		{[]string{`{"msg":"process_starts"}`, `{"msg":"close_stream"}`}, errConnectionClosed},
+	}
+	for _, c := range cases {
+		events, _ := (&Client{t: &scriptedTransport{frames: c.frames}}).SendMessage(context.Background(), Prompt{})
+		var err error
+		for ev := range events {
+			if f, ok := ev.(event.Failed); ok {
+				err = f.Err
+			}
+		}
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v: err = %v, want %v", c.frames, err, c.want)
+		}
+	}
+}
+
+func TestExtractLatestResponse(t *testing.T) {
+	cases := []struct {
+		data []interface{}
+		want string
+	}{
+		{nil, ""},
+		{[]interface{}{nil, "oops"}, ""},
+		{[]interface{}{nil, []interface{}{[]interface{}{"q", nil}}}, ""},
+		{[]interface{}{nil, []interface{}{"q"}}, ""},
+		{[]interface{}{nil, []interface{}{[]interface{}{"q1", "a1"}, []interface{}{"q2", "a2"}}}, "a2"},
+	}
+	for _, c := range cases {
+		if got := extractLatestResponse(c.data); got != c.want {
+			t.Errorf("extractLatestResponse(%v) = %q, want %q", c.data, got, c.want)
+		}
+	}
+}
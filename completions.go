@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"nixiang-gpt/def"
+	"sync"
+	"time"
+
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// maxBatchSessions bounds the upstream sessions of one request: the number
+// of prompts times n.
+const maxBatchSessions = maxChoices
+
+// handleCompletions serves the legacy text completion endpoint. Every prompt
+// of a batch becomes a single user turn with upstream sessions of its own;
+// choice i of prompt p gets the index p*n+i.
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	var req def.OpenAICompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, invalidRequest(err))
+		return
+	}
+	setRequestModel(r.Context(), req.Model)
+	if len(req.Prompt) == 0 {
+		writeError(w, invalidRequestf("prompt is required"))
+		return
+	}
+	n := req.N
+	if n <= 0 {
+		n = 1
+	}
+	if len(req.Prompt)*n > maxBatchSessions {
+		writeError(w, invalidRequestf("prompts times n must be at most %d, got %d", maxBatchSessions, len(req.Prompt)*n))
+		return
+	}
+
+	prompts := make([]Prompt, len(req.Prompt))
+	for i, text := range req.Prompt {
+		prompt, err := buildPrompt(r.Context(), req.Model, []def.OpenAIChatMessage{{Role: "user", Content: text}})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		prompts[i] = prompt
+	}
+	if err := upstreamAvailable(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	lim := limits{stops: req.Stop, maxTokens: req.MaxTokens}
+	response := def.OpenAICompletionResponse{
+		ID:      "cmpl-" + shortuuid.New(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	usage := def.OpenAIUsage{}
+	for _, prompt := range prompts {
+		usage.PromptTokens += promptTokens(prompt)
+	}
+	echo := func(index int) string {
+		if req.Echo {
+			return req.Prompt[index/n]
+		}
+		return ""
+	}
+
+	if !req.Stream {
+		results := make([][]choiceResult, len(prompts))
+		usages := make([]def.OpenAIUsage, len(prompts))
+		errs := make([]error, len(prompts))
+		var wg sync.WaitGroup
+		for i, prompt := range prompts {
+			wg.Add(1)
+			go func(i int, prompt Prompt) {
+				defer wg.Done()
+				results[i], usages[i], errs[i] = runChoices(ctx, n, prompt, lim, false, nil)
+			}(i, prompt)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		response.Choices = []def.OpenAICompletionChoice{}
+		attempts := 0
+		for i, choices := range results {
+			if a := maxAttempts(choices); a > attempts {
+				attempts = a
+			}
+			usage.CompletionTokens += usages[i].CompletionTokens
+			for j, result := range choices {
+				index := i*n + j
+				finishReason := result.finishReason
+				response.Choices = append(response.Choices, def.OpenAICompletionChoice{
+					Text:         echo(index) + result.text,
+					Index:        index,
+					FinishReason: &finishReason,
+				})
+			}
+		}
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		response.Usage = &usage
+		setAttempts(w, attempts)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	total := len(prompts) * n
+	events := make(chan choiceEvent)
+	choices := startChoices(ctx)
+	defer choices.stop()
+	for i := 0; i < total; i++ {
+		choices.stream(i, prompts[i/n], lim, events)
+	}
+	ev, ok := firstEvent(ctx, events)
+	if !ok {
+		return
+	}
+	if ev.err != nil {
+		writeError(w, ev.err)
+		return
+	}
+	setAttempts(w, ev.attempts)
+	attempts := ev.attempts
+	defer func() { setFinalAttempts(w, attempts) }()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errStreamingUnsupported)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	send := func(choices []def.OpenAICompletionChoice, usage *def.OpenAIUsage) {
+		chunk := response
+		chunk.Choices = choices
+		chunk.Usage = usage
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	queue := newQueueReporter(w, flusher, r)
+
+	for i := 0; i < total; i++ {
+		if text := echo(i); text != "" {
+			send([]def.OpenAICompletionChoice{{Text: text, Index: i}}, nil)
+		}
+	}
+	for remaining := total; ; {
+		attempts = max(attempts, ev.attempts)
+		if ev.err != nil {
+			writeStreamError(w, flusher, ev.err)
+			return
+		}
+		if ev.queued != nil {
+			queue.report(ev.index, *ev.queued)
+		}
+		choice := def.OpenAICompletionChoice{Text: ev.delta, Index: ev.index}
+		if ev.finishReason != "" {
+			finishReason := ev.finishReason
+			choice.FinishReason = &finishReason
+			usage.CompletionTokens += ev.tokens
+			remaining--
+		}
+		if ev.delta != "" || ev.finishReason != "" {
+			send([]def.OpenAICompletionChoice{choice}, nil)
+		}
+		if remaining == 0 {
+			break
+		}
+		if ev, ok = nextEvent(ctx, events); !ok {
+			return
+		}
+	}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		send([]def.OpenAICompletionChoice{}, &usage)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func postCompletion(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body)))
+	return rec
+}
+
+func TestCompletion(t *testing.T) {
+	f := useFakeUpstream(t, "Hel", "Hello")
+	rec := postCompletion(t, `{"model":"gpt-4o","prompt":["Say","Greet"],"n":2,"echo":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var response def.OpenAICompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Object != "text_completion" || len(response.Choices) != 4 {
+		t.Fatalf("unexpected response %s", rec.Body)
+	}
+	for i, c := range response.Choices {
+		want := []string{"Say", "Greet"}[i/2] + "Hello"
+		if c.Index != i || c.Text != want || c.FinishReason == nil || *c.FinishReason != "stop" {
+			t.Errorf("choice %d = %+v, want text %q", i, c, want)
+		}
+	}
+	if response.Usage == nil || response.Usage.CompletionTokens == 0 {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+	var messages []string
+	for _, req := range f.received() {
+		messages = append(messages, req.Data[3].(string))
+	}
+	sort.Strings(messages)
+	if strings.Join(messages, ",") != "Greet,Greet,Say,Say" {
+		t.Errorf("upstream received %q", messages)
+	}
+}
+
+func TestCompletionStream(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello")
+	rec := postCompletion(t, `{"model":"gpt-4o","prompt":"Say","stream":true}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	data := sseData(rec.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("stream does not end with [DONE]: %q", data)
+	}
+	var text strings.Builder
+	var finishReason string
+	for _, d := range data[:len(data)-1] {
+		var chunk def.OpenAICompletionResponse
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("chunk %s: %v", d, err)
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Text)
+			if c.FinishReason != nil {
+				finishReason = *c.FinishReason
+			}
+		}
+	}
+	if text.String() != "Hello" || finishReason != "stop" {
+		t.Errorf("text %q, finish reason %q", text.String(), finishReason)
+	}
+}
+
+func TestCompletionSessionLimit(t *testing.T) {
+	f := useFakeUpstream(t, "Hello")
+	prompts, _ := json.Marshal(make([]string, 3))
+	rec := postCompletion(t, `{"model":"gpt-4o","prompt":`+string(prompts)+`,"n":3}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for 9 sessions, want 400", rec.Code)
+	}
+	if len(f.received()) != 0 {
+		t.Errorf("upstream received %d requests", len(f.received()))
+	}
+}
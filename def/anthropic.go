@@ -0,0 +1,112 @@
+package def
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type AnthropicMessagesRequest struct {
+	Model         string             `json:"model"`
+	System        AnthropicContent   `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent is a list of content blocks. A plain string is accepted as
+// a single text block.
+type AnthropicContent []AnthropicContentBlock
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text joins the text blocks.
+func (c AnthropicContent) Text() string {
+	var texts []string
+	for _, block := range c {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+type AnthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text"`
+	Source *AnthropicImageSource `json:"source,omitempty"`
+}
+
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type AnthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicStreamEvent is one server-sent event of a streamed message. Only
+// the fields of the given Type are set.
+type AnthropicStreamEvent struct {
+	Type         string                     `json:"type"`
+	Message      *AnthropicMessagesResponse `json:"message,omitempty"`
+	Index        *int                       `json:"index,omitempty"`
+	ContentBlock *AnthropicContentBlock     `json:"content_block,omitempty"`
+	Delta        *AnthropicStreamDelta      `json:"delta,omitempty"`
+	Usage        *AnthropicDeltaUsage       `json:"usage,omitempty"`
+}
+
+// AnthropicDeltaUsage is the usage sent with message_delta, which only
+// reports the output tokens; the input tokens come with message_start.
+type AnthropicDeltaUsage struct {
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicStreamDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,51 @@
+package def
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+type OpenAICompletionRequest struct {
+	Model         string               `json:"model"`
+	Prompt        PromptList           `json:"prompt"`
+	Stream        bool                 `json:"stream"`
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Echo          bool                 `json:"echo,omitempty"`
+	N             int                  `json:"n,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	Stop          StopSequences        `json:"stop,omitempty"`
+}
+
+// PromptList accepts the prompt of a completion request as a string or as a
+// batch of strings. Token arrays are not supported.
+type PromptList []string
+
+func (p *PromptList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*p = PromptList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("prompt must be a string or an array of strings")
+	}
+	*p = many
+	return nil
+}
+
+type OpenAICompletionResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []OpenAICompletionChoice `json:"choices"`
+	Usage   *OpenAIUsage             `json:"usage,omitempty"`
+}
+
+type OpenAICompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
@@ -0,0 +1,19 @@
+package def
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPromptList(t *testing.T) {
+	var req OpenAICompletionRequest
+	if err := json.Unmarshal([]byte(`{"prompt": "Say hi"}`), &req); err != nil || len(req.Prompt) != 1 || req.Prompt[0] != "Say hi" {
+		t.Errorf("string prompt: got %q, %v", req.Prompt, err)
+	}
+	if err := json.Unmarshal([]byte(`{"prompt": ["a", "b"]}`), &req); err != nil || len(req.Prompt) != 2 {
+		t.Errorf("batch prompt: got %q, %v", req.Prompt, err)
+	}
+	if err := json.Unmarshal([]byte(`{"prompt": [1, 2, 3]}`), &req); err == nil {
+		t.Error("token arrays must be rejected")
+	}
+}
@@ -1,5 +1,7 @@
 package def
 
+import "encoding/json"
+
 type AiRequest struct {
 	Data        []interface{} `json:"data"`
 	EventData   interface{}   `json:"event_data"`
@@ -12,29 +14,142 @@ type AiResponse struct {
 	Output struct {
 		Data         []interface{} `json:"data"`
 		IsGenerating bool          `json:"is_generating"`
+		Error        interface{}   `json:"error"`
 	} `json:"output"`
 	Success bool `json:"success"`
+	// Log is the text of "log" messages, Message that of "unexpected_error".
+	Log     string `json:"log"`
+	Message string `json:"message"`
+	// Rank, QueueSize and RankEta are set on "estimation" messages.
+	Rank      int     `json:"rank"`
+	QueueSize int     `json:"queue_size"`
+	RankEta   float64 `json:"rank_eta"`
 }
 
 type OpenAIChatRequest struct {
-	Model    string              `json:"model"`
-	Stream   bool                `json:"stream"`
-	Messages []OpenAIChatMessage `json:"messages"`
+	Model          string                `json:"model"`
+	Stream         bool                  `json:"stream"`
+	StreamOptions  *OpenAIStreamOptions  `json:"stream_options,omitempty"`
+	Messages       []OpenAIChatMessage   `json:"messages"`
+	N              int                   `json:"n,omitempty"`
+	Stop           StopSequences         `json:"stop,omitempty"`
+	Tools          []OpenAITool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage       `json:"tool_choice,omitempty"`
+	ResponseFormat *OpenAIResponseFormat `json:"response_format,omitempty"`
+	// MaxCompletionTokens supersedes the deprecated MaxTokens.
+	MaxTokens           int `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+}
+
+// MaxOutputTokens returns the completion token limit, 0 meaning unlimited.
+func (r *OpenAIChatRequest) MaxOutputTokens() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
 }
 
 type OpenAIChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	// Images holds the image_url parts of a multimodal content array.
+	Images []OpenAIImageURL `json:"-"`
+}
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"`
+	// Schema is accepted as a shorthand for json_schema.schema.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+type OpenAIJSONSchema struct {
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+type OpenAITool struct {
+	Type     string         `json:"type"`
+	Function OpenAIFunction `json:"function"`
+}
+
+type OpenAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	Index    *int               `json:"index,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+type OpenAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// OpenAIChatResponse is a chat.completion.chunk streamed over SSE.
 type OpenAIChatResponse struct {
+	ID      string             `json:"id,omitempty"`
+	Object  string             `json:"object,omitempty"`
+	Created int64              `json:"created,omitempty"`
+	Model   string             `json:"model,omitempty"`
 	Choices []OpenAIChatChoice `json:"choices"`
+	Usage   *OpenAIUsage       `json:"usage,omitempty"`
 }
 
 type OpenAIChatChoice struct {
-	Delta OpenAIChatDelta `json:"delta"`
+	Index        int             `json:"index"`
+	Delta        OpenAIChatDelta `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type OpenAIChatDelta struct {
-	Content string `json:"content"`
+	Role      string           `json:"role,omitempty"`
+	Content   string           `json:"content,omitempty"`
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIChatCompletion is the non-streaming chat.completion response.
+type OpenAIChatCompletion struct {
+	ID      string                       `json:"id"`
+	Object  string                       `json:"object"`
+	Created int64                        `json:"created"`
+	Model   string                       `json:"model"`
+	Choices []OpenAIChatCompletionChoice `json:"choices"`
+	Usage   OpenAIUsage                  `json:"usage"`
+}
+
+type OpenAIChatCompletionChoice struct {
+	Index        int               `json:"index"`
+	Message      OpenAIChatMessage `json:"message"`
+	FinishReason string            `json:"finish_reason"`
+}
+
+type OpenAIErrorResponse struct {
+	Error OpenAIError `json:"error"`
+}
+
+type OpenAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
 }
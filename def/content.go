@@ -0,0 +1,64 @@
+package def
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OpenAIContentPart is one element of a multimodal content array.
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON accepts content either as a plain string or as an array of
+// content parts. Text parts are joined into Content, image parts go to Images.
+func (m *OpenAIChatMessage) UnmarshalJSON(data []byte) error {
+	type plain OpenAIChatMessage
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = OpenAIChatMessage(raw.plain)
+	m.Content = ""
+	m.Images = nil
+
+	content := strings.TrimSpace(string(raw.Content))
+	if content == "" || content == "null" {
+		return nil
+	}
+	if content[0] == '"' {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+
+	var parts []OpenAIContentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	var texts []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL == nil || part.ImageURL.URL == "" {
+				return fmt.Errorf("image_url content part without url")
+			}
+			m.Images = append(m.Images, *part.ImageURL)
+		default:
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
@@ -0,0 +1,39 @@
+package def
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOpenAIChatMessageContent(t *testing.T) {
+	var msgs []OpenAIChatMessage
+	err := json.Unmarshal([]byte(`[
+		{"role": "user", "content": "你好"},
+		{"role": "user", "content": [
+			{"type": "text", "text": "what is this?"},
+			{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}},
+			{"type": "text", "text": "be brief"}
+		]},
+		{"role": "assistant", "content": null}
+	]`), &msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Content != "你好" || len(msgs[0].Images) != 0 {
+		t.Errorf("plain content: got %+v", msgs[0])
+	}
+	if msgs[1].Content != "what is this?\nbe brief" {
+		t.Errorf("parts content: got %q", msgs[1].Content)
+	}
+	if len(msgs[1].Images) != 1 || msgs[1].Images[0].URL != "data:image/png;base64,AAAA" {
+		t.Errorf("parts images: got %+v", msgs[1].Images)
+	}
+	if msgs[2].Role != "assistant" || msgs[2].Content != "" {
+		t.Errorf("null content: got %+v", msgs[2])
+	}
+
+	var bad OpenAIChatMessage
+	if err := json.Unmarshal([]byte(`{"role":"user","content":[{"type":"audio"}]}`), &bad); err == nil {
+		t.Error("expected error for unsupported part type")
+	}
+}
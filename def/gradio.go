@@ -0,0 +1,7 @@
+package def
+
+// GradioConfig is the part of a Gradio app's /config we care about.
+type GradioConfig struct {
+	Version  string `json:"version"`
+	Protocol string `json:"protocol"`
+}
@@ -0,0 +1,80 @@
+package def
+
+import "encoding/json"
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	// Stream defaults to true when absent.
+	Stream  *bool           `json:"stream,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options OllamaOptions   `json:"options,omitempty"`
+}
+
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options OllamaOptions   `json:"options,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are base64 encoded.
+	Images []string `json:"images,omitempty"`
+}
+
+type OllamaOptions struct {
+	NumPredict int           `json:"num_predict,omitempty"`
+	Stop       StopSequences `json:"stop,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model     string        `json:"model"`
+	CreatedAt string        `json:"created_at"`
+	Message   OllamaMessage `json:"message"`
+	OllamaStats
+}
+
+type OllamaGenerateResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	OllamaStats
+}
+
+// OllamaStats is filled in on the final done message.
+type OllamaStats struct {
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	Format   string   `json:"format"`
+	Family   string   `json:"family"`
+	Families []string `json:"families,omitempty"`
+}
+
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
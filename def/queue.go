@@ -0,0 +1,9 @@
+package def
+
+// QueueStatus is the payload of the queue_status stream event.
+type QueueStatus struct {
+	Index      int     `json:"index"`
+	Position   int     `json:"position"`
+	QueueSize  int     `json:"queue_size"`
+	ETASeconds float64 `json:"eta_seconds"`
+}
@@ -0,0 +1,20 @@
+package def
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RecordedFrame is one line of an upstream session recording.
+type RecordedFrame struct {
+	Time    time.Time       `json:"time"`
+	Dir     string          `json:"dir"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// RecordedSession is the payload of the first line of a recording.
+type RecordedSession struct {
+	Addr        string `json:"addr"`
+	SessionHash string `json:"session_hash"`
+	Protocol    string `json:"protocol"`
+}
@@ -0,0 +1,28 @@
+package def
+
+import "encoding/json"
+
+// StopSequences accepts OpenAI's stop parameter as a string or a list of strings.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = nil
+		if one != "" {
+			*s = StopSequences{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = nil
+	for _, stop := range many {
+		if stop != "" {
+			*s = append(*s, stop)
+		}
+	}
+	return nil
+}
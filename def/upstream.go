@@ -0,0 +1,29 @@
+package def
+
+import "time"
+
+// UpstreamStatus is the state of one upstream mirror as served by
+// /v1/admin/upstreams.
+type UpstreamStatus struct {
+	Addr string `json:"addr"`
+	// Breaker is "closed" while the mirror works, "open" after repeated
+	// failures and "half_open" once it is due to be tried again.
+	Breaker     string     `json:"breaker"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	// HandshakeMs is the duration of the latest successful probe handshake.
+	HandshakeMs float64 `json:"handshake_ms"`
+	// ErrorRate is the share of failed probes and sessions among the
+	// latest Samples.
+	ErrorRate float64 `json:"error_rate"`
+	Samples   int     `json:"samples"`
+	// QueueSize is from the latest queue estimation, if there has been one.
+	QueueSize        *int       `json:"queue_size,omitempty"`
+	QueueSizeUpdated *time.Time `json:"queue_size_updated,omitempty"`
+}
+
+// UpstreamsResponse is the body of /v1/admin/upstreams.
+type UpstreamsResponse struct {
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/lithammer/shortuuid/v4"
 	"log"
+	"nixiang-gpt/event"
 	"sync"
 	"time"
 )
@@ -36,14 +37,18 @@ func main() {
 		panic(err)
 	}
 
-	for {
-		select {
-		case msg, ok := <-messageChan:
-			if !ok {
-				log.Println("Message channel closed")
-				return
-			}
-			log.Printf("Message: %s", msg)
+	for ev := range messageChan {
+		switch ev := ev.(type) {
+		case event.Queued:
+			log.Printf("Queued: #%d of %d, ~%s", ev.Rank+1, ev.QueueSize, ev.ETA.Round(time.Second))
+		case event.Started:
+			log.Println("Started")
+		case event.Delta:
+			log.Printf("Message: %s", ev.HTML)
+		case event.Completed:
+			log.Printf("Completed: %s", ev.Final)
+		case event.Failed:
+			log.Printf("Failed: %v", ev.Err)
 		}
 	}
 }
@@ -89,31 +94,33 @@ func (c *Client) connect() error {
 	return nil
 }
 
-func (c *Client) SendMessage(ctx context.Context, message string, model string) (<-chan string, error) {
-	responseChan := make(chan string)
+func (c *Client) SendMessage(ctx context.Context, message string, model string) (<-chan event.Event, error) {
+	events := make(chan event.Event)
 
-	go c.handleMessageExchange(ctx, message, model, responseChan)
+	go c.handleMessageExchange(ctx, message, model, events)
 
-	return responseChan, nil
+	return events, nil
 }
 
-func (c *Client) handleMessageExchange(ctx context.Context, message string, model string, responseChan chan<- string) {
-	defer close(responseChan)
+func (c *Client) handleMessageExchange(ctx context.Context, message string, model string, events chan<- event.Event) {
+	defer close(events)
 
-	if err := c.performHandshake(); err != nil {
-		responseChan <- fmt.Sprintf("Error: %v", err)
+	if err := c.performHandshake(events); err != nil {
+		events <- event.Failed{Err: err}
 		return
 	}
 
 	if err := c.sendAiRequest(message, model); err != nil {
-		responseChan <- fmt.Sprintf("Error: %v", err)
+		events <- event.Failed{Err: err}
 		return
 	}
 
-	c.processResponses(ctx, responseChan)
+	if err := c.processResponses(ctx, events); err != nil {
+		events <- event.Failed{Err: err}
+	}
 }
 
-func (c *Client) performHandshake() error {
+func (c *Client) performHandshake(events chan<- event.Event) error {
 	if err := c.waitForMessage("send_hash"); err != nil {
 		return fmt.Errorf("waiting for send_hash: %w", err)
 	}
@@ -125,15 +132,24 @@ func (c *Client) performHandshake() error {
 		return fmt.Errorf("sending session hash: %w", err)
 	}
 
-	if err := c.waitForMessage("estimation"); err != nil {
-		return fmt.Errorf("waiting for estimation: %w", err)
-	}
-
-	if err := c.waitForMessage("send_data"); err != nil {
-		return fmt.Errorf("waiting for send_data: %w", err)
+	for {
+		response, err := c.nextMessage()
+		if err != nil {
+			return fmt.Errorf("waiting for send_data: %w", err)
+		}
+		switch response.Msg {
+		case "estimation":
+			events <- event.Queued{
+				Rank:      response.Rank,
+				QueueSize: response.QueueSize,
+				ETA:       time.Duration(response.RankEta * float64(time.Second)),
+			}
+		case "send_data":
+			return nil
+		default:
+			return fmt.Errorf("unexpected message: expected send_data, got %s", response.Msg)
+		}
 	}
-
-	return nil
 }
 
 func (c *Client) sendAiRequest(message string, model string) error {
@@ -149,31 +165,34 @@ func (c *Client) sendAiRequest(message string, model string) error {
 	return c.sendJSON(req)
 }
 
-func (c *Client) processResponses(ctx context.Context, responseChan chan<- string) {
+func (c *Client) processResponses(ctx context.Context, events chan<- event.Event) error {
+	var latest string
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case msg := <-c.receiveChan:
 			var response AiResponse
 			if err := json.Unmarshal(msg, &response); err != nil {
-				responseChan <- fmt.Sprintf("Error unmarshalling response: %v", err)
-				return
+				return fmt.Errorf("unmarshalling response: %w", err)
 			}
 
 			switch response.Msg {
 			case "process_starts":
-				// Process has started, wait for generating messages
+				events <- event.Started{}
 			case "process_generating", "process_completed":
 				if !response.Success {
-					responseChan <- fmt.Sprintf("Error from server: %v", response.Output)
-					return
+					return fmt.Errorf("error from server: %v", response.Output)
 				}
 				if latestResponse := c.extractLatestResponse(response); latestResponse != "" {
-					responseChan <- latestResponse
+					latest = latestResponse
+					if response.Msg == "process_generating" {
+						events <- event.Delta{HTML: latestResponse}
+					}
 				}
 				if response.Msg == "process_completed" {
-					return
+					events <- event.Completed{Final: latest}
+					return nil
 				}
 			default:
 				log.Printf("Unexpected message type: %s", response.Msg)
@@ -209,18 +228,26 @@ func (c *Client) extractLatestResponse(response AiResponse) string {
 }
 
 func (c *Client) waitForMessage(expectedMsg string) error {
+	response, err := c.nextMessage()
+	if err != nil {
+		return err
+	}
+	if response.Msg != expectedMsg {
+		return fmt.Errorf("unexpected message: expected %s, got %s", expectedMsg, response.Msg)
+	}
+	return nil
+}
+
+func (c *Client) nextMessage() (AiResponse, error) {
+	var response AiResponse
 	select {
 	case msg := <-c.receiveChan:
-		var response AiResponse
 		if err := json.Unmarshal(msg, &response); err != nil {
-			return fmt.Errorf("unmarshalling response: %w", err)
-		}
-		if response.Msg != expectedMsg {
-			return fmt.Errorf("unexpected message: expected %s, got %s", expectedMsg, response.Msg)
+			return response, fmt.Errorf("unmarshalling response: %w", err)
 		}
-		return nil
+		return response, nil
 	case <-time.After(waitTimeout):
-		return errors.New("timeout waiting for server message")
+		return response, errors.New("timeout waiting for server message")
 	}
 }
 
@@ -232,7 +259,7 @@ func (c *Client) sendJSON(v interface{}) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Sending: %s", marshal)
+	log.Printf("Sending %d bytes", len(marshal))
 	return c.conn.WriteMessage(websocket.TextMessage, marshal)
 	//return c.conn.WriteJSON(v)
 }
@@ -309,5 +336,8 @@ type AiResponse struct {
 		Data         []interface{} `json:"data"`
 		IsGenerating bool          `json:"is_generating"`
 	} `json:"output"`
-	Success bool `json:"success"`
+	Success   bool    `json:"success"`
+	Rank      int     `json:"rank"`
+	QueueSize int     `json:"queue_size"`
+	RankEta   float64 `json:"rank_eta"`
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"nixiang-gpt/def"
+)
+
+// apiError is a failure reported to API clients. Every front-end renders it in
+// its own error format; the fields follow OpenAI's.
+type apiError struct {
+	status  int
+	typ     string
+	code    string
+	message string
+	// attempts is the number of upstream sessions tried, if any.
+	attempts int
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func invalidRequest(err error) *apiError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &apiError{
+			status:  http.StatusRequestEntityTooLarge,
+			typ:     "invalid_request_error",
+			code:    "request_too_large",
+			message: fmt.Sprintf("the request body exceeds %d bytes", tooLarge.Limit),
+		}
+	}
+	return &apiError{
+		status:  http.StatusBadRequest,
+		typ:     "invalid_request_error",
+		code:    "invalid_request",
+		message: err.Error(),
+	}
+}
+
+func invalidRequestf(format string, args ...interface{}) *apiError {
+	return invalidRequest(fmt.Errorf(format, args...))
+}
+
+// upstreamFailure classifies an error of the upstream session.
+func upstreamFailure(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	e := &apiError{
+		status:  http.StatusBadGateway,
+		typ:     "upstream_error",
+		code:    "upstream_failed",
+		message: err.Error(),
+	}
+	switch {
+	case errors.Is(err, errUpstreamTimeout):
+		e.status = http.StatusGatewayTimeout
+		e.code = "upstream_timeout"
+	case errors.Is(err, errQueueFull):
+		e.status = http.StatusServiceUnavailable
+		e.code = "upstream_queue_full"
+	case errors.Is(err, errInvalidJSON):
+		e.code = "invalid_json_output"
+	}
+	return e
+}
+
+var errStreamingUnsupported = &apiError{
+	status:  http.StatusInternalServerError,
+	typ:     "server_error",
+	code:    "streaming_unsupported",
+	message: "streaming unsupported",
+}
+
+// toAPIError returns err as an apiError, treating unclassified errors as
+// internal failures.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &apiError{
+		status:  http.StatusInternalServerError,
+		typ:     "server_error",
+		code:    "internal_error",
+		message: err.Error(),
+	}
+}
+
+func (e *apiError) openAI() def.OpenAIErrorResponse {
+	return def.OpenAIErrorResponse{Error: def.OpenAIError{
+		Message: e.message,
+		Type:    e.typ,
+		Code:    e.code,
+	}}
+}
+
+// writeError sends err as an OpenAI error response, before any output.
+func writeError(w http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	setAttempts(w, e.attempts)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e.openAI())
+}
+
+// writeStreamError ends an SSE stream that has already started with an error
+// event.
+func writeStreamError(w http.ResponseWriter, flusher http.Flusher, err error) {
+	data, _ := json.Marshal(toAPIError(err).openAI())
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"testing"
+)
+
+func TestUpstreamFailure(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.New("dial tcp: connection refused"), http.StatusBadGateway, "upstream_failed"},
+		{fmt.Errorf("waiting for data: %w", errUpstreamTimeout), http.StatusGatewayTimeout, "upstream_timeout"},
+		{fmt.Errorf("%w: unexpected token", errInvalidJSON), http.StatusBadGateway, "invalid_json_output"},
+		{invalidRequestf("bad image"), http.StatusBadRequest, "invalid_request"},
+	}
+	for _, c := range cases {
+		e := upstreamFailure(c.err)
+		if e.status != c.status || e.code != c.code {
+			t.Errorf("upstreamFailure(%v) = %d %s, want %d %s", c.err, e.status, e.code, c.status, c.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, fmt.Errorf("building prompt: %w", errNoUserMessage))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp def.OpenAIErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Type != "invalid_request_error" || resp.Error.Message == "" {
+		t.Errorf("unexpected error body %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	writeError(rec, errors.New("boom"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unclassified error: status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,43 @@
+// Package event defines the steps of an upstream exchange, as delivered by
+// Client.SendMessage of the proxy and of the demo client.
+package event
+
+import "time"
+
+// Event is one step of an upstream exchange, as delivered by
+// Client.SendMessage: Queued, Started, Delta, Completed or Failed.
+type Event interface {
+	event()
+}
+
+// Queued reports the position in the upstream queue. It may be sent several
+// times while the request waits.
+type Queued struct {
+	Rank      int
+	QueueSize int
+	ETA       time.Duration
+}
+
+// Started means the upstream has begun generating the answer.
+type Started struct{}
+
+// Delta carries the cumulative HTML of the answer so far.
+type Delta struct {
+	HTML string
+}
+
+// Completed ends a successful exchange with the final HTML of the answer.
+type Completed struct {
+	Final string
+}
+
+// Failed ends an exchange that went wrong.
+type Failed struct {
+	Err error
+}
+
+func (Queued) event()    {}
+func (Started) event()   {}
+func (Delta) event()     {}
+func (Completed) event() {}
+func (Failed) event()    {}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeFailure is a way for fakeGradio to misbehave in a session.
+type fakeFailure int
+
+const (
+	fakeOK fakeFailure = iota
+	// fakeQueueFull rejects the session with queue_full.
+	fakeQueueFull
+	// fakeSilent goes quiet after the session hash.
+	fakeSilent
+	// fakeUnsuccessful completes with success false before any output.
+	fakeUnsuccessful
+	// fakeOverloaded is fakeUnsuccessful with an error saying that the model
+	// is busy.
+	fakeOverloaded
+	// fakeDisconnect drops the connection after the second snapshot, by
+	// which the proxy has sent output.
+	fakeDisconnect
+	// fakeStall goes quiet after the second snapshot until the client
+	// closes the connection.
+	fakeStall
+)
+
+// fakeGradio is an in-process gpt_academic upstream speaking the Gradio 3
+// websocket queue protocol.
+type fakeGradio struct {
+	*httptest.Server
+	// answer are the HTML snapshots sent as process_generating; the last one
+	// is also the process_completed output.
+	answer []string
+	// connectDelay stands in for the round trips of connecting to a remote
+	// upstream.
+	connectDelay time.Duration
+	// rank is the queue position sent with the estimation; Gradio ranks
+	// from 0, meaning next in line.
+	rank int
+	// queueDelay is how long sessions wait in the queue after the
+	// estimation.
+	queueDelay time.Duration
+
+	mu sync.Mutex
+	// failures script the sessions in the order they send their hash;
+	// sessions beyond the script behave.
+	failures []fakeFailure
+	// requests are the requests received with send_data.
+	requests []def.AiRequest
+	// closes are the codes of the close frames received.
+	closes []int
+	// sessions tracks the running sessions.
+	sessions sync.WaitGroup
+}
+
+func newFakeGradio(tb testing.TB, answer ...string) *fakeGradio {
+	tb.Helper()
+	f := &fakeGradio{answer: answer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"3.32.0"}`))
+	})
+	mux.HandleFunc("/queue/join", f.serveQueue)
+	f.Server = httptest.NewServer(mux)
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// addr is the websocket address of the queue.
+func (f *fakeGradio) addr() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http") + "/queue/join"
+}
+
+// fail scripts the next sessions.
+func (f *fakeGradio) fail(failures ...fakeFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, failures...)
+}
+
+// received returns the requests received so far.
+func (f *fakeGradio) received() []def.AiRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]def.AiRequest(nil), f.requests...)
+}
+
+func (f *fakeGradio) nextFailure() fakeFailure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failures) == 0 {
+		return fakeOK
+	}
+	failure := f.failures[0]
+	f.failures = f.failures[1:]
+	return failure
+}
+
+var fakeUpgrader = websocket.Upgrader{}
+
+func (f *fakeGradio) serveQueue(w http.ResponseWriter, r *http.Request) {
+	f.sessions.Add(1)
+	defer f.sessions.Done()
+	time.Sleep(f.connectDelay)
+	conn, err := fakeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	send := func(msg map[string]interface{}) bool {
+		return conn.WriteJSON(msg) == nil
+	}
+	var req def.AiRequest
+	if !send(map[string]interface{}{"msg": "send_hash"}) || conn.ReadJSON(&req) != nil {
+		return
+	}
+	failure := f.nextFailure()
+	switch failure {
+	case fakeQueueFull:
+		send(map[string]interface{}{"msg": "queue_full"})
+		return
+	case fakeSilent:
+		// Wait for the client to give up.
+		conn.ReadMessage()
+		return
+	}
+	if !send(map[string]interface{}{"msg": "estimation", "rank": f.rank, "queue_size": f.rank + 1, "rank_eta": 0.1}) {
+		return
+	}
+	time.Sleep(f.queueDelay)
+	if !send(map[string]interface{}{"msg": "send_data"}) ||
+		conn.ReadJSON(&req) != nil {
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	if !send(map[string]interface{}{"msg": "process_starts"}) {
+		return
+	}
+
+	message, _ := req.Data[3].(string)
+	history, _ := req.Data[7].([]interface{})
+	output := func(msg, html string, success bool) map[string]interface{} {
+		chat := append(append([]interface{}{}, history...), []string{message, html})
+		return map[string]interface{}{
+			"msg":     msg,
+			"success": success,
+			"output": map[string]interface{}{
+				"data":          []interface{}{nil, chat},
+				"is_generating": msg == "process_generating",
+			},
+		}
+	}
+	switch failure {
+	case fakeUnsuccessful:
+		send(output("process_completed", "", false))
+		return
+	case fakeOverloaded:
+		msg := output("process_completed", "", false)
+		msg["output"] = map[string]interface{}{"error": "Error code: 503 - model overloaded, try again later"}
+		send(msg)
+		return
+	}
+	var last string
+	for i, html := range f.answer {
+		if !send(output("process_generating", html, true)) {
+			return
+		}
+		if failure == fakeDisconnect && i == 1 {
+			return
+		}
+		if failure == fakeStall && i == 1 {
+			_, _, err := conn.ReadMessage()
+			if ce, ok := err.(*websocket.CloseError); ok {
+				f.mu.Lock()
+				f.closes = append(f.closes, ce.Code)
+				f.mu.Unlock()
+			}
+			return
+		}
+		last = html
+	}
+	send(output("process_completed", last, true))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nixiang-gpt/def"
+	"nixiang-gpt/jsonschema"
+	"strings"
+)
+
+// jsonFormat is the structured output requested through response_format.
+type jsonFormat struct {
+	schema    *jsonschema.Schema
+	rawSchema json.RawMessage
+	name      string
+}
+
+// parseResponseFormat returns nil for plain text output.
+func parseResponseFormat(f *def.OpenAIResponseFormat) (*jsonFormat, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &jsonFormat{}, nil
+	case "json_schema":
+		format := &jsonFormat{rawSchema: f.Schema}
+		if f.JSONSchema != nil {
+			format.name = f.JSONSchema.Name
+			if len(f.JSONSchema.Schema) > 0 {
+				format.rawSchema = f.JSONSchema.Schema
+			}
+		}
+		if len(format.rawSchema) == 0 {
+			return nil, errors.New("response_format json_schema requires a schema")
+		}
+		schema, err := jsonschema.Parse(format.rawSchema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response_format schema: %w", err)
+		}
+		format.schema = schema
+		return format, nil
+	default:
+		return nil, fmt.Errorf("unsupported response_format type %q", f.Type)
+	}
+}
+
+// instructions tells the upstream model how to shape its answer.
+func (f *jsonFormat) instructions() string {
+	var b strings.Builder
+	b.WriteString("Respond with valid JSON only, placed in a single ```json code block, with no other text.")
+	if f.schema == nil {
+		b.WriteString(" The top-level value must be a JSON object.")
+		return b.String()
+	}
+	b.WriteString(" The JSON must conform to this JSON schema")
+	if f.name != "" {
+		fmt.Fprintf(&b, " (%s)", f.name)
+	}
+	b.WriteString(":\n")
+	b.WriteString(compactJSON(f.rawSchema))
+	return b.String()
+}
+
+// check pulls the JSON document out of a converted answer and validates it.
+func (f *jsonFormat) check(text string) (string, error) {
+	doc, err := extractJSON(text)
+	if err != nil {
+		return "", err
+	}
+	if f.schema == nil {
+		if !strings.HasPrefix(doc, "{") {
+			return "", errors.New("the top-level value must be a JSON object")
+		}
+		return doc, nil
+	}
+	if err := f.schema.Validate([]byte(doc)); err != nil {
+		return "", err
+	}
+	return doc, nil
+}
+
+// retryMessage asks the upstream to correct a rejected answer.
+func (f *jsonFormat) retryMessage(err error) string {
+	return fmt.Sprintf("Your previous reply was rejected: %v. Reply again with only the corrected JSON in a single ```json code block.", err)
+}
+
+// extractJSON returns the first JSON object or array found in the Markdown,
+// compacted. Code fence lines are ignored.
+func extractJSON(text string) (string, error) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	text = strings.Join(lines, "\n")
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' && text[i] != '[' {
+			continue
+		}
+		var v json.RawMessage
+		dec := json.NewDecoder(strings.NewReader(text[i:]))
+		if err := dec.Decode(&v); err != nil {
+			continue
+		}
+		return compactJSON(v), nil
+	}
+	return "", errors.New("no JSON value found in the answer")
+}
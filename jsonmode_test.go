@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"nixiang-gpt/def"
+	"testing"
+)
+
+func TestExtractJSON(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"```\n{\"a\": 1,\n \"b\": [true]}\n```", `{"a":1,"b":[true]}`},
+		{"Here you go:\n```\n[1, 2]\n```\nDone.", `[1,2]`},
+		{`The answer is {"name": "张三"} as requested.`, `{"name":"张三"}`},
+		{"{not json} but {\"ok\": true}", `{"ok":true}`},
+	}
+	for _, c := range cases {
+		got, err := extractJSON(c.text)
+		if err != nil || got != c.want {
+			t.Errorf("extractJSON(%q) = %q, %v; want %q", c.text, got, err, c.want)
+		}
+	}
+	if _, err := extractJSON("no json here"); err == nil {
+		t.Error("expected an error without JSON")
+	}
+}
+
+func TestJSONFormatCheck(t *testing.T) {
+	format, err := parseResponseFormat(&def.OpenAIResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &def.OpenAIJSONSchema{
+			Name:   "person",
+			Schema: json.RawMessage(`{"type":"object","required":["name"]}`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := format.check("```\n{\"name\": \"x\"}\n```"); err != nil || doc != `{"name":"x"}` {
+		t.Errorf("valid document: got %q, %v", doc, err)
+	}
+	if _, err := format.check(`{"age": 1}`); err == nil {
+		t.Error("expected a validation error")
+	}
+
+	object, _ := parseResponseFormat(&def.OpenAIResponseFormat{Type: "json_object"})
+	if _, err := object.check("[1]"); err == nil {
+		t.Error("json_object must reject arrays")
+	}
+	if format, err := parseResponseFormat(&def.OpenAIResponseFormat{Type: "text"}); format != nil || err != nil {
+		t.Errorf("text format: got %v, %v", format, err)
+	}
+}
@@ -0,0 +1,410 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a decoded JSON Schema document. Only the keywords structured
+// output relies on are supported: type, enum, const, properties, required,
+// additionalProperties, items, the numeric/length/size bounds, pattern,
+// allOf/anyOf/oneOf and local $ref.
+type Schema struct {
+	root map[string]interface{}
+}
+
+func Parse(data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	m, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+	s := &Schema{root: m}
+	if err := s.checkRefs(m); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkRefs rejects chains of $ref in node that lead back to where they
+// started, which could never validate anything.
+func (s *Schema) checkRefs(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := n["$ref"].(string); ok {
+			seen := map[string]bool{}
+			for ok && !seen[ref] {
+				seen[ref] = true
+				target, err := s.resolve(ref)
+				if err != nil {
+					break
+				}
+				ref, ok = target["$ref"].(string)
+			}
+			if ok {
+				return fmt.Errorf("$ref %q refers to itself", ref)
+			}
+		}
+		for _, v := range n {
+			if err := s.checkRefs(v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range n {
+			if err := s.checkRefs(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validation is the state of one Validate call.
+type validation struct {
+	*Schema
+	// refs are the $refs being followed, by the path of the value they
+	// apply to. Following one again for the same value would never end.
+	refs map[refUse]bool
+}
+
+type refUse struct{ path, ref string }
+
+// Validate checks a JSON document against the schema.
+func (s *Schema) Validate(doc []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	vs := &validation{Schema: s, refs: map[refUse]bool{}}
+	return vs.validate(s.root, v, "")
+}
+
+func (s *validation) validate(schema map[string]interface{}, v interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		key := refUse{path, ref}
+		if s.refs[key] {
+			return fmt.Errorf("%s: $ref %q loops without validating anything", at(path), ref)
+		}
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		s.refs[key] = true
+		defer delete(s.refs, key)
+		return s.validate(target, v, path)
+	}
+
+	if t, ok := schema["type"]; ok {
+		if err := checkType(t, v, path); err != nil {
+			return err
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value must be one of %s", at(path), compact(enum))
+		}
+	}
+	if c, ok := schema["const"]; ok && !equal(c, v) {
+		return fmt.Errorf("%s: value must be %s", at(path), compact(c))
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(schema, val, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(schema, val, path); err != nil {
+			return err
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := number(schema["minLength"]); ok && n < min {
+			return fmt.Errorf("%s: string shorter than %v", at(path), min)
+		}
+		if max, ok := number(schema["maxLength"]); ok && n > max {
+			return fmt.Errorf("%s: string longer than %v", at(path), max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q: %w", at(path), pattern, err)
+			}
+			if !re.MatchString(val) {
+				return fmt.Errorf("%s: string does not match %q", at(path), pattern)
+			}
+		}
+	case json.Number:
+		f, _ := val.Float64()
+		if min, ok := number(schema["minimum"]); ok && f < min {
+			return fmt.Errorf("%s: %v is less than %v", at(path), val, min)
+		}
+		if max, ok := number(schema["maximum"]); ok && f > max {
+			return fmt.Errorf("%s: %v is greater than %v", at(path), val, max)
+		}
+		if min, ok := number(schema["exclusiveMinimum"]); ok && f <= min {
+			return fmt.Errorf("%s: %v must be greater than %v", at(path), val, min)
+		}
+		if max, ok := number(schema["exclusiveMaximum"]); ok && f >= max {
+			return fmt.Errorf("%s: %v must be less than %v", at(path), val, max)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if err := s.validateSub(sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErr error
+		matched := false
+		for _, sub := range anyOf {
+			err := s.validateSub(sub, v, path)
+			if err == nil {
+				matched = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value matches none of anyOf (%v)", at(path), firstErr)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if s.validateSub(sub, v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: value must match exactly one of oneOf, matched %d", at(path), matches)
+		}
+	}
+	return nil
+}
+
+func (s *validation) validateObject(schema map[string]interface{}, obj map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at(path), name)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		child := path + "/" + escape(k)
+		if sub, ok := properties[k]; ok {
+			if err := s.validateSub(sub, obj[k], child); err != nil {
+				return err
+			}
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: unexpected property %q", at(path), k)
+			}
+		case map[string]interface{}:
+			if err := s.validate(extra, obj[k], child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *validation) validateArray(schema map[string]interface{}, arr []interface{}, path string) error {
+	n := float64(len(arr))
+	if min, ok := number(schema["minItems"]); ok && n < min {
+		return fmt.Errorf("%s: array has fewer than %v items", at(path), min)
+	}
+	if max, ok := number(schema["maxItems"]); ok && n > max {
+		return fmt.Errorf("%s: array has more than %v items", at(path), max)
+	}
+	if items, ok := schema["items"]; ok {
+		for i, item := range arr {
+			if err := s.validateSub(items, item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *validation) validateSub(sub interface{}, v interface{}, path string) error {
+	switch schema := sub.(type) {
+	case map[string]interface{}:
+		return s.validate(schema, v, path)
+	case bool:
+		if !schema {
+			return fmt.Errorf("%s: no value is allowed here", at(path))
+		}
+	}
+	return nil
+}
+
+// resolve follows a local reference such as "#/$defs/item".
+func (s *Schema) resolve(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref %q is not a schema", ref)
+	}
+	return m, nil
+}
+
+func checkType(t interface{}, v interface{}, path string) error {
+	var types []string
+	switch tt := t.(type) {
+	case string:
+		types = []string{tt}
+	case []interface{}:
+		for _, x := range tt {
+			if s, ok := x.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	actual := typeOf(v)
+	for _, want := range types {
+		if want == actual || (want == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", at(path), strings.Join(types, " or "), actual)
+}
+
+func typeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := val.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// equal compares a schema value (decoded with float64 numbers) with a document
+// value (decoded with json.Number).
+func equal(a, b interface{}) bool {
+	if na, ok := number(a); ok {
+		nb, ok := number(b)
+		return ok && na == nb
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k := range av {
+			if !equal(av[k], bv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func compact(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func at(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,86 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	schema, err := Parse([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2},
+			"kind": {"enum": ["a", "b"]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		doc  string
+		want string
+	}{
+		{`{"name": "张三", "age": 3, "tags": ["x"], "kind": "a"}`, ""},
+		{`{"name": "张三"}`, `missing required property "age"`},
+		{`{"name": "", "age": 3}`, "/name: string shorter than 1"},
+		{`{"name": "x", "age": 1.5}`, "/age: expected integer, got number"},
+		{`{"name": "x", "age": -1}`, "/age: -1 is less than 0"},
+		{`{"name": "x", "age": 1, "tags": ["A"]}`, `/tags/0: string does not match`},
+		{`{"name": "x", "age": 1, "tags": ["a", "b", "c"]}`, "/tags: array has more than 2 items"},
+		{`{"name": "x", "age": 1, "kind": "c"}`, `/kind: value must be one of ["a","b"]`},
+		{`{"name": "x", "age": 1, "extra": true}`, `unexpected property "extra"`},
+		{`[1, 2]`, "/: expected object, got array"},
+		{`{"name": `, "invalid JSON"},
+	}
+	for _, c := range cases {
+		err := schema.Validate([]byte(c.doc))
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.doc, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.doc, c.want, err)
+		}
+	}
+}
+
+func TestRefLoops(t *testing.T) {
+	for _, schema := range []string{
+		`{"$ref": "#"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		`{"type": "object", "properties": {"x": {"$ref": "#/properties/x"}}}`,
+	} {
+		if _, err := Parse([]byte(schema)); err == nil || !strings.Contains(err.Error(), "refers to itself") {
+			t.Errorf("Parse(%s) = %v, want a $ref loop error", schema, err)
+		}
+	}
+
+	// A loop through allOf only shows when validating.
+	s, err := Parse([]byte(`{"allOf": [{"$ref": "#"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate([]byte(`{}`)); err == nil || !strings.Contains(err.Error(), "loops") {
+		t.Errorf("Validate = %v, want a $ref loop error", err)
+	}
+
+	// Recursion into the value is fine.
+	s, err = Parse([]byte(`{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate([]byte(`{"children": [{"children": []}, {}]}`)); err != nil {
+		t.Errorf("Validate of a tree = %v", err)
+	}
+	if err := s.Validate([]byte(`{"children": [{"children": 1}]}`)); err == nil {
+		t.Error("Validate accepted a bad subtree")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listenConfig is how the server takes connections.
+type listenConfig struct {
+	// addr is a TCP address, or a Unix socket path prefixed with "unix:".
+	addr string
+	// certFile and keyFile enable TLS; the pair is reloaded when either
+	// file changes.
+	certFile string
+	keyFile  string
+	// clientCAFile requires clients to present a certificate signed by one
+	// of its CAs.
+	clientCAFile string
+	// h2c serves HTTP/2 without TLS alongside HTTP/1.1. Over TLS, HTTP/2 is
+	// always negotiated.
+	h2c bool
+}
+
+func (c listenConfig) tls() bool {
+	return c.certFile != "" || c.keyFile != ""
+}
+
+// listen opens the listener of addr. A stale Unix socket left behind by a
+// previous run is removed first.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	path = strings.TrimPrefix(path, "//")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serve configures srv as c asks and serves it on ln until it is shut down.
+func (c listenConfig) serve(srv *http.Server, ln net.Listener) error {
+	if c.clientCAFile != "" && !c.tls() {
+		return errors.New("client certificates need TLS")
+	}
+	if !c.tls() {
+		if c.h2c {
+			h2s := &http2.Server{}
+			// Lets Shutdown close HTTP/2 connections gracefully too.
+			if err := http2.ConfigureServer(srv, h2s); err != nil {
+				return err
+			}
+			handler := srv.Handler
+			if handler == nil {
+				handler = http.DefaultServeMux
+			}
+			srv.Handler = h2c.NewHandler(handler, h2s)
+		}
+		return srv.Serve(ln)
+	}
+
+	config, err := serverTLSConfig(c.certFile, c.keyFile, c.clientCAFile)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = config
+	return srv.ServeTLS(ln, "", "")
+}
+
+// serverTLSConfig returns the TLS configuration serving the certificate in
+// certFile and keyFile and, if clientCAFile is set, requiring client
+// certificates signed by its CAs.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most.
+const certCheckInterval = time.Second
+
+// certReloader serves a certificate from files, picking up renewals without
+// a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // the later one of the two files
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesModTime is the modification time of the file changed last.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate; r.mu is held or r is not shared yet.
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		// Keep serving the old certificate while the new one is being
+		// written, or if it is broken.
+		if modTime, err := r.filesModTime(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				r.modTime = modTime
+				slog.Warn("reloading certificate", "cert", r.certFile, "error", err)
+			} else {
+				slog.Info("reloaded certificate", "cert", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// writeCert writes a certificate for localhost and its key to dir, signed by
+// parent, or self-signed if parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+// serveTest serves a handler reporting the protocol as lc asks and returns
+// its address.
+func serveTest(t *testing.T, lc listenConfig) string {
+	t.Helper()
+	ln, err := listen(lc.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})}
+	served := make(chan error, 1)
+	go func() { served <- lc.serve(srv, ln) }()
+	t.Cleanup(func() {
+		srv.Shutdown(context.Background())
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url string) (string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _, ca := writeCert(t, dir, "ca", nil)
+	certFile, keyFile, _ := writeCert(t, dir, "server", &ca)
+	_, _, clientCert := writeCert(t, dir, "client", &ca)
+	addr := serveTest(t, listenConfig{addr: "127.0.0.1:0", certFile: certFile, keyFile: keyFile, clientCAFile: caFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	proto, err := get(t, client(clientCert), "https://"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("served %s, want HTTP/2.0", proto)
+	}
+	if _, err := get(t, client(), "https://"+addr); err == nil {
+		t.Error("served a client without certificate")
+	}
+}
+
+func TestServeH2CUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	serveTest(t, listenConfig{addr: "unix:" + path, h2c: true})
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	proto, err := get(t, client, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("served %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestListenUnixInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:" + path); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	// A socket left behind by a crash is taken over.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writeCert(t, dir, "server", nil)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() *big.Int {
+		t.Helper()
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber
+	}
+	if got := serial(); got.Cmp(first.Leaf.SerialNumber) != 0 {
+		t.Fatalf("serving serial %v, want %v", got, first.Leaf.SerialNumber)
+	}
+
+	// A broken certificate is not picked up.
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	os.Chtimes(certFile, later, later)
+	r.checked = time.Time{}
+	if got := serial(); got.Cmp(first.Leaf.SerialNumber) != 0 {
+		t.Errorf("serving serial %v after a broken renewal, want %v", got, first.Leaf.SerialNumber)
+	}
+
+	_, _, second := writeCert(t, dir, "server", nil)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	r.checked = time.Time{}
+	if got := serial(); got.Cmp(second.Leaf.SerialNumber) != 0 {
+		t.Errorf("serving serial %v after renewal, want %v", got, second.Leaf.SerialNumber)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lithammer/shortuuid/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// contentPolicy is how prompts, answers and upstream payloads appear in logs.
+type contentPolicy int
+
+const (
+	// contentRedact logs only the size of the content.
+	contentRedact contentPolicy = iota
+	// contentTruncate logs the start of the content.
+	contentTruncate
+	// contentFull logs the content as it is.
+	contentFull
+)
+
+func parseContentPolicy(s string) (contentPolicy, error) {
+	switch s {
+	case "redact":
+		return contentRedact, nil
+	case "truncate":
+		return contentTruncate, nil
+	case "full":
+		return contentFull, nil
+	}
+	return 0, fmt.Errorf("unknown content logging %q, want redact, truncate or full", s)
+}
+
+// logContent and logContentLimit control how content is logged; see
+// redacted.
+var (
+	logContent      = contentRedact
+	logContentLimit = 64
+)
+
+// redacted is user content that is logged as logContent allows.
+type redacted string
+
+func (s redacted) LogValue() slog.Value {
+	switch logContent {
+	case contentFull:
+		return slog.StringValue(string(s))
+	case contentTruncate:
+		if len(s) <= logContentLimit {
+			return slog.StringValue(string(s))
+		}
+		cut := logContentLimit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		return slog.StringValue(fmt.Sprintf("%s… (%d bytes)", s[:cut], len(s)))
+	}
+	return slog.StringValue(fmt.Sprintf("[redacted %d bytes]", len(s)))
+}
+
+// newLogger returns a logger writing to w in the given format, "json" or
+// "text", at the given level.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, want json or text", format)
+}
+
+type loggerKey struct{}
+
+// logger returns the logger of the request ctx belongs to, which tags every
+// record with the request ID.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+const requestIDHeader = "X-Request-Id"
+
+// logRequests is the router middleware giving every request an ID, taken
+// from the X-Request-Id header if the client sent one, and logging the
+// request once it is done.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = shortuuid.New()
+		}
+		w.Header().Set(requestIDHeader, id)
+		l := slog.Default().With("request_id", id)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = l.With("trace_id", sc.TraceID().String())
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+
+		level := slog.LevelInfo
+		if sw.code() >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		l.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.code(),
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
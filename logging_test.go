@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	defer func(p contentPolicy, n int) { logContent, logContentLimit = p, n }(logContent, logContentLimit)
+	logContentLimit = 4
+	s := redacted("你好, world")
+	cases := []struct {
+		policy contentPolicy
+		want   string
+	}{
+		{contentRedact, "[redacted 13 bytes]"},
+		// The limit falls inside 好, so only 你 is kept.
+		{contentTruncate, "你… (13 bytes)"},
+		{contentFull, "你好, world"},
+	}
+	for _, c := range cases {
+		logContent = c.policy
+		if got := s.LogValue().String(); got != c.want {
+			t.Errorf("policy %d: %q, want %q", c.policy, got, c.want)
+		}
+	}
+}
+
+// TestLogRequests checks that the records of a request carry its ID and leave
+// out the prompt.
+func TestLogRequests(t *testing.T) {
+	useFakeUpstream(t, "Hello")
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d *slog.Logger) { slog.SetDefault(d) }(slog.Default())
+	slog.SetDefault(l)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"my secret question"}]}`))
+	req.Header.Set(requestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get(requestIDHeader) != "req-1" {
+		t.Fatalf("status %d, request ID %q", rec.Code, rec.Header().Get(requestIDHeader))
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("the prompt was logged:\n%s", buf.String())
+	}
+	msgs := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if record["request_id"] != nil && record["request_id"] != "req-1" {
+			t.Errorf("record with request_id %v", record["request_id"])
+		}
+		if record["request_id"] == "req-1" {
+			msgs[record["msg"].(string)] = true
+		}
+	}
+	if !msgs["joining upstream queue"] || !msgs["upstream send"] || !msgs["request"] {
+		t.Errorf("records of the request: %v", msgs)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	if rec.Header().Get(requestIDHeader) == "" {
+		t.Error("no request ID generated")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at /metrics. Latencies are in seconds; answers
+// can take minutes on a busy mirror, hence the long buckets.
+var (
+	latencyBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Requests handled, by route, model, status code and API key fingerprint (see -metrics-keys).",
+	}, []string{"route", "model", "status", "key"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time from receiving a request to finishing its response.",
+		Buckets: latencyBuckets,
+	}, []string{"route", "model"})
+	responseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_response_bytes_total",
+		Help: "Bytes written to clients, streamed or not.",
+	}, []string{"route"})
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "time_to_first_token_seconds",
+		Help:    "Time from starting an answer to its first delta, including queueing and retries.",
+		Buckets: latencyBuckets,
+	}, []string{"model"})
+	upstreamQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upstream_queue_wait_seconds",
+		Help:    "Time from the first queue estimation of an upstream session to the start of processing.",
+		Buckets: latencyBuckets,
+	})
+	upstreamQueueWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upstream_queue_waiting",
+		Help: "Upstream sessions currently waiting in an upstream queue.",
+	})
+	upstreamQueuePosition = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upstream_queue_position",
+		Help:    "Position of upstream sessions in the upstream queue when they joined it, 1 being next in line.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+	upstreamQueueETA = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upstream_queue_eta_seconds",
+		Help:    "Wait estimated by the upstream when a session joined its queue.",
+		Buckets: latencyBuckets,
+	})
+	upstreamQueueSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_queue_size",
+		Help: "Length of the queue last reported by an upstream, by host.",
+	}, []string{"host"})
+	upstreamHandshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_handshake_failures_total",
+		Help: "Upstream sessions that failed before the upstream took the request, by host.",
+	}, []string{"host"})
+	upstreamSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upstream_sessions_active",
+		Help: "Upstream sessions currently open.",
+	})
+	conversionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "conversion_errors_total",
+		Help: "Upstream output that could not be converted, by kind.",
+	}, []string{"kind"})
+)
+
+// Kinds of conversion errors.
+const (
+	conversionFrame = "frame"       // an upstream message that is not JSON
+	conversionDiff  = "output_diff" // an output diff that does not apply
+	conversionJSON  = "json_output" // an answer that fails the JSON format
+)
+
+// modelLabel bounds the model label to the catalog.
+func modelLabel(model string) string {
+	if _, ok := lookupModel(model); ok {
+		return model
+	}
+	return "other"
+}
+
+// metricsKeys are the fingerprints of the API keys that requests are counted
+// by; requests with other keys are counted as "other", which keeps the number
+// of series bounded.
+var metricsKeys = map[string]bool{}
+
+// parseMetricsKeys parses the comma-separated fingerprints of -metrics-keys.
+func parseMetricsKeys(s string) error {
+	for _, fp := range strings.Split(s, ",") {
+		fp = strings.ToLower(strings.TrimSpace(fp))
+		if fp == "" {
+			continue
+		}
+		if _, err := hex.DecodeString(fp); err != nil || len(fp) != 8 {
+			return fmt.Errorf("%q is not a key fingerprint of 8 hex digits", fp)
+		}
+		metricsKeys[fp] = true
+	}
+	return nil
+}
+
+// keyFingerprint is a short fingerprint of an API key, the first 8 hex digits
+// of its SHA-256.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// keyLabel is the fingerprint of the caller's API key if it is one of
+// metricsKeys, so requests can be told apart by key without exposing it.
+func keyLabel(r *http.Request) string {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	if key == "" {
+		return "none"
+	}
+	if fp := keyFingerprint(key); metricsKeys[fp] {
+		return fp
+	}
+	return "other"
+}
+
+// hostLabel is the host of an upstream address.
+func hostLabel(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
+
+type modelKey struct{}
+
+// setRequestModel records the model named by the request ctx belongs to, once
+// its handler has decoded it, for the labels of the request metrics.
+func setRequestModel(ctx context.Context, model string) {
+	if m, ok := ctx.Value(modelKey{}).(*string); ok {
+		*m = model
+	}
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// code is the status of the response, 200 if the handler did not set one.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// routeOf is the path template of the route matched by r.
+func routeOf(r *http.Request) string {
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tmpl, err := cur.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// instrument is the router middleware recording the request metrics.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeOf(r)
+		var model string
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), modelKey{}, &model)))
+		model = modelLabel(model)
+
+		requestsTotal.WithLabelValues(route, model, strconv.Itoa(sw.code()), keyLabel(r)).Inc()
+		requestDuration.WithLabelValues(route, model).Observe(time.Since(start).Seconds())
+		responseBytes.WithLabelValues(route).Add(float64(sw.bytes))
+	})
+}
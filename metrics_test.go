@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello")
+	router := newRouter()
+	requests := requestsTotal.WithLabelValues("/v1/chat/completions", "gpt-4o", "200", keyLabel(&http.Request{
+		Header: http.Header{"Authorization": {"Bearer sk-test"}},
+	}))
+	before := testutil.ToFloat64(requests)
+	bytesBefore := testutil.ToFloat64(responseBytes.WithLabelValues("/v1/chat/completions"))
+
+	for _, stream := range []string{"false", "true"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","stream":`+stream+`,"messages":[{"role":"user","content":"Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Hel") {
+			t.Fatalf("stream %s: %d %s", stream, rec.Code, rec.Body)
+		}
+	}
+	if got := testutil.ToFloat64(requests) - before; got != 2 {
+		t.Errorf("counted %v requests, want 2", got)
+	}
+	if testutil.ToFloat64(responseBytes.WithLabelValues("/v1/chat/completions")) == bytesBefore {
+		t.Error("response bytes not counted")
+	}
+	// Every API's handler records the model it decoded.
+	generate := requestsTotal.WithLabelValues("/api/generate", "gpt-4o", "200", "none")
+	before = testutil.ToFloat64(generate)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/generate",
+		strings.NewReader(`{"model":"gpt-4o","prompt":"Hi","stream":false}`)))
+	if got := testutil.ToFloat64(generate) - before; rec.Code != http.StatusOK || got != 1 {
+		t.Errorf("/api/generate: %d, counted %v requests for gpt-4o", rec.Code, got)
+	}
+	if got := testutil.ToFloat64(upstreamSessions); got != 0 {
+		t.Errorf("%v upstream sessions left active", got)
+	}
+
+	rec = httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{
+		"http_request_duration_seconds_bucket",
+		"time_to_first_token_seconds_bucket",
+		"upstream_queue_wait_seconds_bucket",
+		"upstream_queue_position_bucket",
+		"upstream_queue_size",
+	} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("/metrics lacks %s", name)
+		}
+	}
+}
+
+func TestKeyLabel(t *testing.T) {
+	bearer := &http.Request{Header: http.Header{"Authorization": {"Bearer sk-secret"}}}
+	anthropic := &http.Request{Header: http.Header{"X-Api-Key": {"sk-secret"}}}
+	if got := keyLabel(bearer); got != "other" {
+		t.Errorf("keyLabel of a key not in -metrics-keys = %q", got)
+	}
+
+	defer func(keys map[string]bool) { metricsKeys = keys }(metricsKeys)
+	metricsKeys = map[string]bool{}
+	fp := keyFingerprint("sk-secret")
+	if err := parseMetricsKeys(" " + strings.ToUpper(fp) + ",0badc0de"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keyLabel(bearer); got != fp || keyLabel(anthropic) != fp || len(got) != 8 || strings.Contains(got, "secret") {
+		t.Errorf("keyLabel = %q and %q, want %q", got, keyLabel(anthropic), fp)
+	}
+	if got := keyLabel(&http.Request{Header: http.Header{}}); got != "none" {
+		t.Errorf("keyLabel without a key = %q", got)
+	}
+	if err := parseMetricsKeys("sk-secret"); err == nil {
+		t.Error("parseMetricsKeys accepted a key instead of its fingerprint")
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	useFakeUpstream(t, "Hello")
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"` + strings.Repeat("a", maxRequestBody) + `"}]}`
+	for _, path := range []string{"/v1/chat/completions", "/v1/messages"} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "request_too_large") {
+			t.Errorf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+// modelInfo describes a model offered by the upstream gpt_academic mirrors.
+type modelInfo struct {
+	name   string
+	family string
+	// vision models accept image input.
+	vision bool
+}
+
+var modelCatalog = []modelInfo{
+	{name: "gpt-3.5-turbo", family: "gpt"},
+	{name: "gpt-4", family: "gpt"},
+	{name: "gpt-4-turbo", family: "gpt", vision: true},
+	{name: "gpt-4-vision-preview", family: "gpt", vision: true},
+	{name: "gpt-4o", family: "gpt", vision: true},
+	{name: "gpt-4o-mini", family: "gpt", vision: true},
+	{name: "gemini-1.5-pro", family: "gemini", vision: true},
+	{name: "gemini-1.5-flash", family: "gemini", vision: true},
+	{name: "glm-4", family: "glm"},
+	{name: "glm-4v", family: "glm", vision: true},
+	{name: "qwen-turbo", family: "qwen"},
+	{name: "deepseek-chat", family: "deepseek"},
+}
+
+func lookupModel(name string) (modelInfo, bool) {
+	for _, m := range modelCatalog {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return modelInfo{}, false
+}
+
+func supportsVision(model string) bool {
+	m, ok := lookupModel(model)
+	return ok && m.vision
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"nixiang-gpt/def"
+	"time"
+)
+
+// ollamaEpoch is reported as modified_at of every model in /api/tags.
+var ollamaEpoch = time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+
+// handleOllamaChat serves Ollama's /api/chat.
+func handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	var req def.OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, invalidRequest(err))
+		return
+	}
+	setRequestModel(r.Context(), req.Model)
+	var messages []def.OpenAIChatMessage
+	for _, m := range req.Messages {
+		messages = append(messages, def.OpenAIChatMessage{
+			Role:    m.Role,
+			Content: m.Content,
+			Images:  ollamaImages(m.Images),
+		})
+	}
+	prompt, format, ok := ollamaPrompt(w, r, req.Model, messages, req.Format)
+	if !ok {
+		return
+	}
+
+	serveOllama(w, r, prompt, req.Stream, format, req.Options, func(text string, stats def.OllamaStats) interface{} {
+		return def.OllamaChatResponse{
+			Model:       req.Model,
+			CreatedAt:   time.Now().UTC().Format(time.RFC3339Nano),
+			Message:     def.OllamaMessage{Role: "assistant", Content: text},
+			OllamaStats: stats,
+		}
+	})
+}
+
+// handleOllamaGenerate serves Ollama's /api/generate.
+func handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	var req def.OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, invalidRequest(err))
+		return
+	}
+	setRequestModel(r.Context(), req.Model)
+	messages := []def.OpenAIChatMessage{{
+		Role:    "user",
+		Content: req.Prompt,
+		Images:  ollamaImages(req.Images),
+	}}
+	prompt, format, ok := ollamaPrompt(w, r, req.Model, messages, req.Format)
+	if !ok {
+		return
+	}
+	if req.System != "" {
+		prompt.SystemPrompt = req.System
+	}
+
+	serveOllama(w, r, prompt, req.Stream, format, req.Options, func(text string, stats def.OllamaStats) interface{} {
+		return def.OllamaGenerateResponse{
+			Model:       req.Model,
+			CreatedAt:   time.Now().UTC().Format(time.RFC3339Nano),
+			Response:    text,
+			OllamaStats: stats,
+		}
+	})
+}
+
+// handleOllamaTags lists the model catalog as Ollama's /api/tags.
+func handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	response := def.OllamaTagsResponse{Models: []def.OllamaModel{}}
+	for _, m := range modelCatalog {
+		response.Models = append(response.Models, def.OllamaModel{
+			Name:       m.name,
+			Model:      m.name,
+			ModifiedAt: ollamaEpoch.Format(time.RFC3339),
+			Details: def.OllamaModelDetails{
+				Format:   "api",
+				Family:   m.family,
+				Families: []string{m.family},
+			},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ollamaPrompt validates the request and builds the upstream prompt. It
+// writes the error response itself and reports whether to go on.
+func ollamaPrompt(w http.ResponseWriter, r *http.Request, model string, messages []def.OpenAIChatMessage, rawFormat json.RawMessage) (Prompt, *jsonFormat, bool) {
+	if err := checkImageSupport(model, messages); err != nil {
+		writeOllamaError(w, invalidRequest(err))
+		return Prompt{}, nil, false
+	}
+	format, err := parseResponseFormat(ollamaFormat(rawFormat))
+	if err != nil {
+		writeOllamaError(w, invalidRequest(err))
+		return Prompt{}, nil, false
+	}
+	prompt, err := buildPrompt(r.Context(), model, messages)
+	if err != nil {
+		writeOllamaError(w, err)
+		return Prompt{}, nil, false
+	}
+	if format != nil {
+		prompt.SystemPrompt += "\n\n" + format.instructions()
+	}
+	if err := upstreamAvailable(); err != nil {
+		writeOllamaError(w, err)
+		return Prompt{}, nil, false
+	}
+	return prompt, format, true
+}
+
+// serveOllama runs the prompt and writes the answer as NDJSON, or as a single
+// object when streaming is off. wrap builds one response line.
+func serveOllama(w http.ResponseWriter, r *http.Request, prompt Prompt, stream *bool, format *jsonFormat, opts def.OllamaOptions, wrap func(text string, stats def.OllamaStats) interface{}) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	lim := limits{stops: opts.Stop, maxTokens: opts.NumPredict}
+	stats := def.OllamaStats{Done: true, PromptEvalCount: promptTokens(prompt)}
+
+	// Ollama streams unless told otherwise; JSON output needs the whole answer.
+	if (stream != nil && !*stream) || format != nil {
+		results, usage, err := runChoices(ctx, 1, prompt, lim, false, format)
+		if err != nil {
+			writeOllamaError(w, err)
+			return
+		}
+		stats.DoneReason = results[0].finishReason
+		stats.EvalCount = usage.CompletionTokens
+		stats.TotalDuration = time.Since(start).Nanoseconds()
+		setAttempts(w, results[0].attempts)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wrap(results[0].text, stats))
+		return
+	}
+
+	events := make(chan choiceEvent)
+	choices := startChoices(ctx)
+	defer choices.stop()
+	choices.stream(0, prompt, lim, events)
+	ev, ok := firstEvent(ctx, events)
+	if !ok {
+		return
+	}
+	if ev.err != nil {
+		writeOllamaError(w, ev.err)
+		return
+	}
+
+	setAttempts(w, ev.attempts)
+	attempts := ev.attempts
+	defer func() { setFinalAttempts(w, attempts) }()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOllamaError(w, errStreamingUnsupported)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for {
+		attempts = max(attempts, ev.attempts)
+		if ev.err != nil {
+			// Ollama clients look for an error field on any line.
+			enc.Encode(def.OllamaErrorResponse{Error: ev.err.Error()})
+			flusher.Flush()
+			return
+		}
+		if ev.delta != "" {
+			enc.Encode(wrap(ev.delta, def.OllamaStats{}))
+			flusher.Flush()
+		}
+		if ev.finishReason != "" {
+			stats.DoneReason = ev.finishReason
+			stats.EvalCount = ev.tokens
+			stats.TotalDuration = time.Since(start).Nanoseconds()
+			enc.Encode(wrap("", stats))
+			flusher.Flush()
+			return
+		}
+		if ev, ok = nextEvent(ctx, events); !ok {
+			return
+		}
+	}
+}
+
+// writeOllamaError sends err in Ollama's {"error": "..."} format.
+func writeOllamaError(w http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	setAttempts(w, e.attempts)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(def.OllamaErrorResponse{Error: e.message})
+}
+
+// ollamaFormat maps Ollama's format ("json" or a JSON schema) onto
+// response_format.
+func ollamaFormat(raw json.RawMessage) *def.OpenAIResponseFormat {
+	if len(raw) == 0 || string(raw) == "null" || string(raw) == `""` {
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return &def.OpenAIResponseFormat{Type: "json_object"}
+	}
+	return &def.OpenAIResponseFormat{Type: "json_schema", Schema: raw}
+}
+
+// ollamaImages turns Ollama's bare base64 images into data URLs.
+func ollamaImages(images []string) []def.OpenAIImageURL {
+	var out []def.OpenAIImageURL
+	for _, img := range images {
+		// 64 base64 characters decode to enough bytes to sniff the type.
+		prefix := img
+		if len(prefix) > 64 {
+			prefix = prefix[:64]
+		}
+		mediaType := "image/png"
+		if head, err := base64.StdEncoding.DecodeString(prefix); err == nil {
+			mediaType = http.DetectContentType(head)
+		}
+		out = append(out, def.OpenAIImageURL{URL: "data:" + mediaType + ";base64," + img})
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postOllama(t *testing.T, handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return rec
+}
+
+// ndjsonLines decodes every line of an NDJSON body, appending to the slice
+// lines points to.
+func ndjsonLines(t *testing.T, body string, lines interface{}) {
+	t.Helper()
+	var raw []json.RawMessage
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		raw = append(raw, json.RawMessage(scanner.Text()))
+	}
+	data, _ := json.Marshal(raw)
+	if err := json.Unmarshal(data, lines); err != nil {
+		t.Fatalf("%s: %v", body, err)
+	}
+}
+
+func TestOllamaFormat(t *testing.T) {
+	if f := ollamaFormat(nil); f != nil {
+		t.Errorf("no format: got %+v", f)
+	}
+	if f := ollamaFormat(json.RawMessage(`"json"`)); f == nil || f.Type != "json_object" {
+		t.Errorf("json format: got %+v", f)
+	}
+	f := ollamaFormat(json.RawMessage(`{"type":"object"}`))
+	if f == nil || f.Type != "json_schema" || string(f.Schema) != `{"type":"object"}` {
+		t.Errorf("schema format: got %+v", f)
+	}
+}
+
+func TestOllamaImages(t *testing.T) {
+	// A PNG signature followed by padding.
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	images := ollamaImages([]string{png})
+	if len(images) != 1 || !strings.HasPrefix(images[0].URL, "data:image/png;base64,iVBOR") {
+		t.Errorf("got %+v", images)
+	}
+}
+
+func TestOllamaChatStream(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello, wor", "Hello, world!")
+	// Ollama streams when stream is absent.
+	rec := postOllama(t, handleOllamaChat, "/api/chat",
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"Say hello"}]}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status = %d, content type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var lines []def.OllamaChatResponse
+	ndjsonLines(t, rec.Body.String(), &lines)
+	if len(lines) < 2 {
+		t.Fatalf("got %d lines: %s", len(lines), rec.Body)
+	}
+	var content strings.Builder
+	for _, line := range lines[:len(lines)-1] {
+		if line.Done || line.Message.Role != "assistant" {
+			t.Errorf("unexpected line %+v", line)
+		}
+		content.WriteString(line.Message.Content)
+	}
+	if content.String() != "Hello, world!" {
+		t.Errorf("content %q", content.String())
+	}
+	last := lines[len(lines)-1]
+	if !last.Done || last.DoneReason != "stop" || last.Message.Content != "" ||
+		last.EvalCount == 0 || last.PromptEvalCount == 0 {
+		t.Errorf("last line %+v", last)
+	}
+}
+
+func TestOllamaChat(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello, world!")
+	rec := postOllama(t, handleOllamaChat, "/api/chat",
+		`{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Say hello"}]}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var lines []def.OllamaChatResponse
+	ndjsonLines(t, rec.Body.String(), &lines)
+	if len(lines) != 1 || !lines[0].Done || lines[0].DoneReason != "stop" ||
+		lines[0].Message.Content != "Hello, world!" || lines[0].Model != "gpt-4o" {
+		t.Errorf("unexpected response %s", rec.Body)
+	}
+}
+
+func TestOllamaGenerateStream(t *testing.T) {
+	f := useFakeUpstream(t, "Hel", "Hello")
+	rec := postOllama(t, handleOllamaGenerate, "/api/generate",
+		`{"model":"gpt-4o","prompt":"Say hello","stream":true}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status = %d, content type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var lines []def.OllamaGenerateResponse
+	ndjsonLines(t, rec.Body.String(), &lines)
+	if len(lines) < 2 {
+		t.Fatalf("got %d lines: %s", len(lines), rec.Body)
+	}
+	var response strings.Builder
+	for _, line := range lines[:len(lines)-1] {
+		if line.Done {
+			t.Errorf("done before the last line: %+v", line)
+		}
+		response.WriteString(line.Response)
+	}
+	if last := lines[len(lines)-1]; response.String() != "Hello" || !last.Done || last.DoneReason != "stop" {
+		t.Errorf("response %q, last line %+v", response.String(), last)
+	}
+	if reqs := f.received(); len(reqs) != 1 || reqs[0].Data[3] != "Say hello" {
+		t.Errorf("upstream received %+v", reqs)
+	}
+}
+
+func TestOllamaGenerateJSON(t *testing.T) {
+	useFakeUpstream(t, `<p>Sure: {"greeting": "hello"}</p>`)
+	// JSON output needs the whole answer, so it does not stream.
+	rec := postOllama(t, handleOllamaGenerate, "/api/generate",
+		`{"model":"gpt-4o","prompt":"Greet me in JSON","format":"json"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var response def.OllamaGenerateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Done || response.Response != `{"greeting":"hello"}` {
+		t.Errorf("unexpected response %s", rec.Body)
+	}
+}
+
+func TestOllamaTags(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleOllamaTags(rec, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var tags def.OllamaTagsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags.Models) != len(modelCatalog) {
+		t.Fatalf("got %d models, want %d", len(tags.Models), len(modelCatalog))
+	}
+	for i, m := range tags.Models {
+		want := modelCatalog[i]
+		if m.Name != want.name || m.Model != want.name || m.Details.Family != want.family ||
+			m.ModifiedAt != ollamaEpoch.Format(time.RFC3339) {
+			t.Errorf("model %d = %+v, want %s", i, m, want.name)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// warmConnections is the number of websocket connections kept dialled ahead
+// of time for every upstream; 0 disables the pool.
+var warmConnections = 2
+
+// warmMaxIdle is how long a dialled connection may wait for a request before
+// it is considered stale.
+const warmMaxIdle = 30 * time.Second
+
+// wsDialer is shared by all websocket connections, so TLS sessions are
+// resumed instead of negotiated afresh on every dial.
+var wsDialer = &websocket.Dialer{
+	HandshakeTimeout: 45 * time.Second,
+	TLSClientConfig:  &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)},
+}
+
+// upstreamHTTP is the client of the SSE transport. Its connections are kept
+// alive, so joining the queue does not pay for a fresh TLS handshake.
+var upstreamHTTP = &http.Client{Transport: newUpstreamTransport()}
+
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 16
+	return t
+}
+
+// wsPool holds websocket connections to one upstream that have been dialled
+// before they were needed. Gradio serves a single queue job per connection,
+// so connections never return to the pool; it only takes the dial and the
+// TLS and websocket handshakes out of the request path.
+type wsPool struct {
+	addr    string
+	mu      sync.Mutex
+	idle    []pooledConn
+	dialing int
+	closed  bool
+}
+
+type pooledConn struct {
+	t      *wsTransport
+	dialed time.Time
+}
+
+// pools holds the wsPool of every upstream address.
+var pools sync.Map
+
+// takeWebsocket returns a connection to addr, warm from the pool if possible,
+// and tops the pool up in the background.
+func takeWebsocket(addr string) (*wsTransport, error) {
+	if warmConnections <= 0 {
+		return dialWebsocket(addr)
+	}
+	p, _ := pools.LoadOrStore(addr, &wsPool{addr: addr})
+	pool := p.(*wsPool)
+	defer pool.refill()
+	if t := pool.take(); t != nil {
+		return t, nil
+	}
+	return dialWebsocket(addr)
+}
+
+// take returns the freshest usable connection, closing stale ones.
+func (p *wsPool) take() *wsTransport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(c.dialed) < warmMaxIdle && !c.t.closed() {
+			return c.t
+		}
+		c.t.Close()
+	}
+	return nil
+}
+
+// refill dials connections until the pool is full again.
+func (p *wsPool) refill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && len(p.idle)+p.dialing < warmConnections {
+		p.dialing++
+		go func() {
+			t, err := dialWebsocket(p.addr)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.dialing--
+			switch {
+			case err != nil:
+			case p.closed:
+				t.Close()
+			default:
+				p.idle = append(p.idle, pooledConn{t: t, dialed: time.Now()})
+			}
+		}()
+	}
+}
+
+// close closes the idle connections and stops the pool from dialling more.
+func (p *wsPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.t.Close()
+	}
+	p.idle = nil
+}
+
+// closePools closes the warm connections to every upstream.
+func closePools() {
+	pools.Range(func(_, p interface{}) bool {
+		p.(*wsPool).close()
+		return true
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"nixiang-gpt/event"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitWarm waits until the pool of addr holds n connections.
+func waitWarm(tb testing.TB, addr string, n int) {
+	tb.Helper()
+	p, _ := pools.Load(addr)
+	pool := p.(*wsPool)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pool.mu.Lock()
+		idle := len(pool.idle)
+		pool.mu.Unlock()
+		if idle >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("pool holds %d connections, want %d", idle, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	f := newFakeGradio(t, "Hi")
+	if _, err := takeWebsocket(f.addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitWarm(t, f.addr(), warmConnections)
+
+	// A warm connection serves a whole exchange.
+	client, err := NewClient(f.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	events, _ := client.SendMessage(context.Background(), Prompt{Message: "hello"})
+	var final string
+	for ev := range events {
+		switch ev := ev.(type) {
+		case event.Completed:
+			final = ev.Final
+		case event.Failed:
+			t.Fatal(ev.Err)
+		}
+	}
+	if final != "Hi" {
+		t.Errorf("final = %q, want %q", final, "Hi")
+	}
+}
+
+// BenchmarkTimeToFirstToken measures the time from opening a session to the
+// first answer delta, with and without warm connections, against an upstream
+// that takes 10ms to connect to. The warm case waits for the pool to refill
+// between iterations, so run it with a fixed count, e.g. -benchtime=100x.
+func BenchmarkTimeToFirstToken(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bc := range []struct {
+		name string
+		warm int
+	}{{"cold", 0}, {"warm", 2}} {
+		b.Run(bc.name, func(b *testing.B) {
+			defer func(n int) { warmConnections = n }(warmConnections)
+			warmConnections = bc.warm
+			f := newFakeGradio(b, "Hel", "Hello")
+			f.connectDelay = 10 * time.Millisecond
+			probeProtocol(f.addr())
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if bc.warm > 0 {
+					if i == 0 {
+						takeWebsocket(f.addr())
+					}
+					waitWarm(b, f.addr(), 1)
+				}
+				b.StartTimer()
+
+				client, err := NewClient(f.addr())
+				if err != nil {
+					b.Fatal(err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				events, _ := client.SendMessage(ctx, Prompt{Message: "hello"})
+				for ev := range events {
+					if _, ok := ev.(event.Delta); ok {
+						break
+					}
+					if f, ok := ev.(event.Failed); ok {
+						b.Fatal(f.Err)
+					}
+				}
+				cancel()
+				client.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"nixiang-gpt/def"
+	"nixiang-gpt/event"
+	"strings"
+	"time"
+)
+
+// queueHeartbeat is how often the last queue position is repeated while a
+// request waits upstream without the queue moving. It is also how long a
+// streamed request waits in the queue before its headers are sent.
+var queueHeartbeat = 15 * time.Second
+
+// queueReporter tells a streaming client where its request stands in the
+// upstream queue. By default it writes SSE comments, which clients ignore but
+// which keep idle proxies from closing the connection. With the request
+// header "X-Queue-Status: events" it sends queue_status events instead.
+type queueReporter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	events  bool
+}
+
+func newQueueReporter(w http.ResponseWriter, flusher http.Flusher, r *http.Request) queueReporter {
+	return queueReporter{
+		w:       w,
+		flusher: flusher,
+		events:  strings.EqualFold(r.Header.Get("X-Queue-Status"), "events"),
+	}
+}
+
+func (q queueReporter) report(index int, status event.Queued) {
+	// Gradio ranks from 0, meaning next in line.
+	position := status.Rank + 1
+	if q.events {
+		data, _ := json.Marshal(def.QueueStatus{
+			Index:      index,
+			Position:   position,
+			QueueSize:  status.QueueSize,
+			ETASeconds: status.ETA.Seconds(),
+		})
+		fmt.Fprintf(q.w, "event: queue_status\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprintf(q.w, ": queued #%d of %d, ~%s\n\n", position, status.QueueSize, status.ETA.Round(time.Second))
+	}
+	q.flusher.Flush()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"nixiang-gpt/event"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueReporter(t *testing.T) {
+	status := event.Queued{Rank: 4, QueueSize: 12, ETA: 19600 * time.Millisecond}
+
+	rec := httptest.NewRecorder()
+	newQueueReporter(rec, rec, httptest.NewRequest("POST", "/", nil)).report(0, status)
+	if got, want := rec.Body.String(), ": queued #5 of 12, ~20s\n\n"; got != want {
+		t.Errorf("comment = %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("X-Queue-Status", "events")
+	newQueueReporter(rec, rec, req).report(1, status)
+	got := rec.Body.String()
+	if !strings.HasPrefix(got, "event: queue_status\ndata: ") ||
+		!strings.Contains(got, `"index":1,"position":5,"queue_size":12,"eta_seconds":19.6`) {
+		t.Errorf("event = %q", got)
+	}
+}
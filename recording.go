@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nixiang-gpt/def"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordDir is where every upstream session is recorded, if set.
+var recordDir string
+
+// Directions of recorded frames.
+const (
+	recordSession = "session" // the first line, describing the session
+	recordJoin    = "join"    // the request as it joined the queue
+	recordOut     = "out"     // a message sent to the upstream
+	recordIn      = "in"      // a message received from the upstream
+)
+
+// recordingTransport writes every frame passing through a transport to a
+// JSONL file, one def.RecordedFrame per line.
+type recordingTransport struct {
+	transport
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// record wraps the transport of c to record its session into recordDir.
+func record(c *Client, proto queueProtocol) error {
+	name := fmt.Sprintf("%s-%s.jsonl", time.Now().UTC().Format("20060102-150405"), c.sessionHash)
+	f, err := os.Create(filepath.Join(recordDir, name))
+	if err != nil {
+		return fmt.Errorf("recording session: %w", err)
+	}
+	t := &recordingTransport{transport: c.t, f: f, enc: json.NewEncoder(f)}
+	t.write(recordSession, def.RecordedSession{
+		Addr:        c.addr,
+		SessionHash: c.sessionHash,
+		Protocol:    proto.String(),
+	})
+	c.t = t
+	return nil
+}
+
+func (t *recordingTransport) write(dir string, payload interface{}) {
+	var raw json.RawMessage
+	switch p := payload.(type) {
+	case []byte:
+		raw = p
+		if !json.Valid(p) {
+			raw, _ = json.Marshal(string(p))
+		}
+	default:
+		raw, _ = json.Marshal(p)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(def.RecordedFrame{Time: time.Now(), Dir: dir, Payload: raw})
+}
+
+func (t *recordingTransport) join(ctx context.Context, req def.AiRequest) error {
+	t.write(recordJoin, req)
+	return t.transport.join(ctx, req)
+}
+
+func (t *recordingTransport) send(ctx context.Context, v interface{}) error {
+	t.write(recordOut, v)
+	return t.transport.send(ctx, v)
+}
+
+func (t *recordingTransport) receive(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	frame, err := t.transport.receive(ctx, timeout)
+	if frame != nil {
+		t.write(recordIn, frame)
+	}
+	return frame, err
+}
+
+func (t *recordingTransport) Close() error {
+	err := t.transport.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.f.Close()
+	return err
+}
+
+// replayTransport plays back the received frames of a recording, as fast as
+// they are asked for.
+type replayTransport struct {
+	frames [][]byte
+}
+
+func (t *replayTransport) join(ctx context.Context, req def.AiRequest) error {
+	return nil
+}
+
+func (t *replayTransport) send(ctx context.Context, v interface{}) error {
+	return nil
+}
+
+func (t *replayTransport) receive(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if len(t.frames) == 0 {
+		return nil, errConnectionClosed
+	}
+	frame := t.frames[0]
+	t.frames = t.frames[1:]
+	return frame, nil
+}
+
+func (t *replayTransport) Close() error {
+	return nil
+}
+
+// loadRecording returns a client that replays the recorded session at path.
+func loadRecording(path string) (*Client, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Client{t: &replayTransport{}}
+	t := c.t.(*replayTransport)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	for line := 1; scanner.Scan(); line++ {
+		var frame def.RecordedFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		switch frame.Dir {
+		case recordSession:
+			var session def.RecordedSession
+			if err := json.Unmarshal(frame.Payload, &session); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			c.addr, c.sessionHash = session.Addr, session.SessionHash
+			c.diffs = session.Protocol == protocolSSE.String()
+		case recordIn:
+			t.frames = append(t.frames, frame.Payload)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.frames) == 0 {
+		return nil, errors.New("recording has no received frames")
+	}
+	return c, nil
+}
+
+// replayRecording runs the recorded session at path through the protocol
+// handling and the Markdown conversion and returns the answer.
+func replayRecording(path string) (string, error) {
+	client, err := loadRecording(path)
+	if err != nil {
+		return "", err
+	}
+	var answer strings.Builder
+	_, err = streamSession(context.Background(), client, Prompt{}, limits{}, func(ev choiceEvent) bool {
+		answer.WriteString(ev.delta)
+		return true
+	})
+	return answer.String(), err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nixiang-gpt/def"
+)
+
+// gptAcademicAnswer are snapshots of a gpt_academic answer with a code block.
+var gptAcademicAnswer = []string{
+	`<div class="markdown-body"><p>下面是一个例子：</p></div>`,
+	`<div class="markdown-body"><p>下面是一个例子：</p>
+<div class="codehilite"><pre><span></span><code><span class="kd">func</span><span class="w"> </span><span class="nx">main</span><span class="p">()</span><span class="w"> </span><span class="p">{</span>
+</code></pre></div></div>`,
+	`<div class="markdown-body"><p>下面是一个例子：</p>
+<div class="codehilite"><pre><span></span><code><span class="kd">func</span><span class="w"> </span><span class="nx">main</span><span class="p">()</span><span class="w"> </span><span class="p">{</span>
+<span class="w">    </span><span class="nx">fmt</span><span class="p">.</span><span class="nx">Println</span><span class="p">(</span><span class="s">&quot;hi&quot;</span><span class="p">)</span>
+<span class="p">}</span>
+</code></pre></div>
+<p>运行它会打印 <code>hi</code>。</p></div>`,
+}
+
+func TestRecordReplay(t *testing.T) {
+	useFakeUpstream(t, gptAcademicAnswer...)
+	dir := t.TempDir()
+	recordDir = dir
+	defer func() { recordDir = "" }()
+
+	live, err := runPrompt(context.Background(), Prompt{Message: "举个例子"}, limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("recorded %d sessions, want 1", len(files))
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var frame def.RecordedFrame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, frame.Dir)
+	}
+	if got := strings.Join(dirs, " "); !strings.HasPrefix(got, "session join in out in in out in in") {
+		t.Errorf("recorded directions %s", got)
+	}
+
+	replayed, err := replayRecording(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != live.text {
+		t.Errorf("replay = %q, live = %q", replayed, live.text)
+	}
+}
+
+// TestRecordings replays the recordings in testdata/recordings and compares
+// the answers with the Markdown files next to them. A recording attached to a
+// bug report becomes a regression test by adding it there with the expected
+// answer.
+func TestRecordings(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "recordings", "*.jsonl"))
+	if len(files) == 0 {
+		t.Fatal("no recordings")
+	}
+	for _, file := range files {
+		want, err := os.ReadFile(strings.TrimSuffix(file, ".jsonl") + ".md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := replayRecording(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if got != string(want) {
+			t.Errorf("%s: answer\n%s\nwant\n%s", file, got, want)
+		}
+	}
+}
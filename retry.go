@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// retryPolicy says how failed upstream sessions are retried. Only failures
+// before the first delta are retried, as the client has seen nothing yet.
+type retryPolicy struct {
+	// attempts is the maximum number of sessions per choice, 1 meaning no
+	// retries.
+	attempts int
+	// backoff is the delay before the first retry; it doubles with every
+	// further one up to maxBackoff.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+var upstreamRetry = retryPolicy{
+	attempts:   3,
+	backoff:    500 * time.Millisecond,
+	maxBackoff: 8 * time.Second,
+}
+
+// delay returns the wait after the given number of failed attempts: the
+// exponential backoff with full jitter in its upper half.
+func (p retryPolicy) delay(failed int) time.Duration {
+	d := p.backoff
+	for i := 1; i < failed && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports whether a failed upstream session is worth another try:
+// the upstream could not be reached, was too busy, went silent or went away.
+// A failure the upstream reports itself is usually about the request, such as
+// an unsupported model, unless its message tells of a transient cause.
+// Everything else, such as an unsupported protocol, would fail the same way
+// again.
+func retryable(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, websocket.ErrBadHandshake),
+		errors.Is(err, errQueueFull),
+		errors.Is(err, errUpstreamTimeout),
+		errors.Is(err, errConnectionClosed):
+		return true
+	case errors.Is(err, errUpstreamFailed):
+		return transientFailure(err.Error())
+	}
+	return false
+}
+
+// transientCauses are the parts of upstream failure messages that say the
+// model behind the upstream was busy or out of reach, in lower case.
+var transientCauses = []string{
+	"timeout", "timed out", "rate limit", "too many requests", "overloaded",
+	"temporarily", "try again", "connection", "502", "503", "504",
+}
+
+func transientFailure(message string) bool {
+	message = strings.ToLower(message)
+	for _, cause := range transientCauses {
+		if strings.Contains(message, cause) {
+			return true
+		}
+	}
+	return false
+}
+
+// attemptsHeader reports how many upstream sessions the most retried choice
+// of a request needed. A streamed response sends the header with its first
+// event, when a choice may still be retried; the final count follows as a
+// trailer of the same name.
+const attemptsHeader = "X-Upstream-Attempts"
+
+func setAttempts(w http.ResponseWriter, attempts int) {
+	if attempts > 0 {
+		w.Header().Set(attemptsHeader, strconv.Itoa(attempts))
+	}
+}
+
+// setFinalAttempts sends the attempts of a streamed response as a trailer.
+func setFinalAttempts(w http.ResponseWriter, attempts int) {
+	if attempts > 0 {
+		w.Header().Set(http.TrailerPrefix+attemptsHeader, strconv.Itoa(attempts))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	_, dialErr := net.Dial("tcp", "127.0.0.1:0")
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("failed to connect: %w", dialErr), true},
+		{fmt.Errorf("joining queue: %w", errQueueFull), true},
+		{fmt.Errorf("joining queue: %w", errUpstreamTimeout), true},
+		{fmt.Errorf("queued: %w", errConnectionClosed), true},
+		{fmt.Errorf("%w: boom", errUpstreamFailed), false},
+		{errUpstreamFailed, false},
+		{fmt.Errorf("%w: Connection error.", errUpstreamFailed), true},
+		{fmt.Errorf("%w: Error code: 429 - Rate limit reached", errUpstreamFailed), true},
+		{errors.New(`unsupported Gradio queue protocol "sse_v1" (version 4.0.0)`), false},
+		{fmt.Errorf("unmarshalling response: %w", errors.New("bad json")), false},
+		{context.Canceled, false},
+	}
+	for _, c := range cases {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{attempts: 5, backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for failed, max := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		6: time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			if d := p.delay(failed); d < max/2 || d > max {
+				t.Fatalf("delay(%d) = %v, want within [%v, %v]", failed, d, max/2, max)
+			}
+		}
+	}
+}
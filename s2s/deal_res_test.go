@@ -1,11 +0,0 @@
-package s2s
-
-import (
-	"fmt"
-	"testing"
-)
-
-func TestDealRes(t *testing.T) {
-	var res = `"<div class=\"markdown-body\"><p>好的，这里是一个更详细的 <code>pom.xml</code> 示例文件，可以作为你Java项目的基础：</p>\n<div class=\"codehilite\"><pre><span></span><code><span class=\"nt\">&lt;project</span><span class=\"w\"> </span><span class=\"na\">xmlns=</span><span class=\"s\">&quot;http://maven.apache.org/POM/4.0.0&quot;</span>\n<span class=\"w\">         </span><span class=\"na\">xmlns:xsi=</span><span class=\"s\">&quot;http://www.w3.org/2001/XMLSchema-instance&quot;</span>\n<span class=\"w\">         </span><span class=\"na\">xsi:schemaLocation=</span><span class=\"s\">&quot;http://maven.apache.org/POM/4.0.0 http://maven.apache.org/xsd/maven-4.0.0.xsd&quot;</span><span class=\"nt\">&gt;</span>\n\n<span class=\"w\">    </span><span class=\"nt\">&lt;modelVersion&gt;</span>4.0.0<span class=\"nt\">&lt;/modelVersion&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 项目基本信息 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;groupId&gt;</span>com.example<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;artifactId&gt;</span>my-app<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;version&gt;</span>1.0.0<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;packaging&gt;</span>jar<span class=\"nt\">&lt;/packaging&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 项目名称及描述 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;name&gt;</span>My<span class=\"w\"> </span>Application<span class=\"nt\">&lt;/name&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;description&gt;</span>A<span class=\"w\"> </span>simple<span class=\"w\"> </span>Maven<span class=\"w\"> </span>project<span class=\"nt\">&lt;/description&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;url&gt;</span>http://www.example.com<span class=\"nt\">&lt;/url&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 配置属性 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;properties&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;maven.compiler.source&gt;</span>1.8<span class=\"nt\">&lt;/maven.compiler.source&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;maven.compiler.target&gt;</span>1.8<span class=\"nt\">&lt;/maven.compiler.target&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;project.build.sourceEncoding&gt;</span>UTF-8<span class=\"nt\">&lt;/project.build.sourceEncoding&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;/properties&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 依赖项 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;dependencies&gt;</span>\n<span class=\"w\">        </span><span class=\"cm\">&lt;!-- JUnit 依赖项，用于单元测试 --&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;dependency&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;groupId&gt;</span>junit<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;artifactId&gt;</span>junit<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;version&gt;</span>4.13.2<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;scope&gt;</span>test<span class=\"nt\">&lt;/scope&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;/dependency&gt;</span>\n\n<span class=\"w\">        </span><span class=\"cm\">&lt;!-- Spring Core 依赖项 --&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;dependency&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;groupId&gt;</span>org.springframework<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;artifactId&gt;</span>spring-core<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;version&gt;</span>5.3.8<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;/dependency&gt;</span>\n\n<span class=\"w\">        </span><span class=\"cm\">&lt;!-- Spring Context 依赖项 --&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;dependency&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;groupId&gt;</span>org.springframework<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;artifactId&gt;</span>spring-context<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;version&gt;</span>5.3.8<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;/dependency&gt;</span>\n\n<span class=\"w\">        </span><span class=\"cm\">&lt;!-- 其他依赖项可以添加在这里 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;/dependencies&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 构建配置信息 --&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;build&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;plugins&gt;</span>\n<span class=\"w\">            </span><span class=\"cm\">&lt;!-- 编译插件 --&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;plugin&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;groupId&gt;</span>org.apache.maven.plugins<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;artifactId&gt;</span>maven-compiler-plugin<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;version&gt;</span>3.8.1<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;configuration&gt;</span>\n<span class=\"w\">                    </span><span class=\"nt\">&lt;source&gt;</span>1.8<span class=\"nt\">&lt;/source&gt;</span>\n<span class=\"w\">                    </span><span class=\"nt\">&lt;target&gt;</span>1.8<span class=\"nt\">&lt;/target&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;/configuration&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;/plugin&gt;</span>\n\n<span class=\"w\">            </span><span class=\"cm\">&lt;!-- Surefire 插件，用于运行单元测试 --&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;plugin&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;groupId&gt;</span>org.apache.maven.plugins<span class=\"nt\">&lt;/groupId&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;artifactId&gt;</span>maven-surefire-plugin<span class=\"nt\">&lt;/artifactId&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;version&gt;</span>2.22.2<span class=\"nt\">&lt;/version&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;configuration&gt;</span>\n<span class=\"w\">                    </span><span class=\"nt\">&lt;includes&gt;</span>\n<span class=\"w\">                        </span><span class=\"nt\">&lt;include&gt;</span>**/*Test.java<span class=\"nt\">&lt;/include&gt;</span>\n<span class=\"w\">                    </span><span class=\"nt\">&lt;/includes&gt;</span>\n<span class=\"w\">                </span><span class=\"nt\">&lt;/configuration&gt;</span>\n<span class=\"w\">            </span><span class=\"nt\">&lt;/plugin&gt;</span>\n\n<span class=\"w\">            </span><span class=\"cm\">&lt;!-- 其他插件可以添加在这里 --&gt;</span>\n<span class=\"w\">        </span><span class=\"nt\">&lt;/plugins&gt;</span>\n<span class=\"w\">    </span><span class=\"nt\">&lt;/build&gt;</span>\n\n<span class=\"w\">    </span><span class=\"cm\">&lt;!-- 其他配置可以添加在这里，例如开发者信息、组织信息等 --&gt;</span>\n<span class=\"nt\">&lt;/project&gt;</span>\n</code></pre></div>\n<p>这个 <code>pom.xml</code> 文件包括：</p>\n<ol>\n<li><strong>基本项目信息</strong> <code>groupId</code>, <code>artifactId</code>, <code>version</code>, 和 <code>packaging</code>。</li>\n<li><strong>项目信息</strong> <code>name</code>, <code>description</code>, 和 <code>url</code>。</li>\n<li><strong>配置属性</strong> <code>maven.compiler.source</code>, <code>maven.compiler.target</code>, 和 <code>project.build.sourceEncoding</code>。</li>\n<li><strong>依赖项</strong> 用于包括需要的库，例如 JUnit 和 Spring 框架。</li>\n<li><strong>构建信息</strong> 包含插件的配置，例如 <code>maven-compiler-plugin</code> 和 <code>maven-surefire-plugin</code>。</li>\n</ol>\n<p>你可以根据具体的项目要求添加和修改相应的部分，如果你有其他特定的需求，也可以随时告诉我！</p></div>"`
-	fmt.Print(DealRes(res))
-}
@@ -0,0 +1,31 @@
+package s2s
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+// addGolden seeds a fuzzer with the answers of the golden files.
+func addGolden(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "golden", "*.html"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+}
+
+func FuzzDealRes(f *testing.F) {
+	addGolden(f)
+	f.Add("<pre><code>\xff</code></pre>")
+	f.Fuzz(func(t *testing.T, in string) {
+		out := DealRes(in)
+		if utf8.ValidString(in) && !utf8.ValidString(out) {
+			t.Errorf("DealRes(%q) = %q is not valid UTF-8", in, out)
+		}
+	})
+}
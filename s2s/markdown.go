@@ -0,0 +1,409 @@
+package s2s
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// DealRes converts an answer rendered by the upstream into the Markdown it was
+// rendered from. Content that cannot be parsed converts to nothing.
+func DealRes(input string) string {
+	md, rest := DealResPartial(input)
+	return md + rest
+}
+
+// DealResPartial converts a snapshot of an answer that is still being
+// generated. If the snapshot ends inside a code block, the closing fence is
+// left out of md and returned as rest: the upstream renders an unfinished
+// block as closed, and the block's text may still grow. The snapshots of one
+// answer then convert to Markdown that only ever grows at the end.
+func DealResPartial(input string) (md, rest string) {
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		return "", ""
+	}
+	blocks := renderBlocks(doc)
+	if len(blocks) == 0 {
+		return "", ""
+	}
+	texts := make([]string, len(blocks))
+	for i, b := range blocks {
+		texts[i] = b.text
+	}
+	last := blocks[len(blocks)-1]
+	if last.open == "" {
+		return strings.Join(texts, "\n\n"), ""
+	}
+	texts[len(texts)-1] = last.open
+	return strings.Join(texts, "\n\n"), last.text[len(last.open):]
+}
+
+// mdBlock is a block of Markdown, such as a paragraph or a list.
+type mdBlock struct {
+	text string
+	// open is the text of a code block without its closing fence.
+	open string
+}
+
+// htmlSpace are the white space characters of HTML.
+const htmlSpace = " \t\n\f\r"
+
+// renderBlocks renders the children of n as blocks. Runs of inline content
+// between block elements become paragraphs.
+func renderBlocks(n *html.Node) []mdBlock {
+	var blocks []mdBlock
+	var inline strings.Builder
+	flush := func() {
+		text := strings.Trim(inline.String(), "\n")
+		inline.Reset()
+		// White space between block elements is only formatting.
+		if strings.Trim(text, htmlSpace) != "" {
+			blocks = append(blocks, mdBlock{text: text})
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !isBlock(c) {
+			inline.WriteString(renderInline(c))
+			continue
+		}
+		flush()
+		blocks = append(blocks, renderBlock(c)...)
+	}
+	flush()
+	return blocks
+}
+
+func isBlock(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.Data {
+	case "html", "head", "body", "div", "section", "article", "p", "pre",
+		"ol", "ul", "table", "blockquote", "hr",
+		"h1", "h2", "h3", "h4", "h5", "h6":
+		return true
+	}
+	return false
+}
+
+func renderBlock(n *html.Node) []mdBlock {
+	switch n.Data {
+	case "head":
+		return nil
+	case "p":
+		if text := strings.TrimSpace(renderInlines(n)); text != "" {
+			return []mdBlock{{text: text}}
+		}
+		return nil
+	case "pre":
+		return []mdBlock{renderCode(n)}
+	case "ol", "ul":
+		if text := renderList(n); text != "" {
+			return []mdBlock{{text: text}}
+		}
+		return nil
+	case "table":
+		if text := renderTable(n); text != "" {
+			return []mdBlock{{text: text}}
+		}
+		return nil
+	case "blockquote":
+		text := joinBlocks(renderBlocks(n), "\n\n")
+		if text == "" {
+			return nil
+		}
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return []mdBlock{{text: strings.Join(lines, "\n")}}
+	case "hr":
+		return []mdBlock{{text: "---"}}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level := int(n.Data[1] - '0')
+		text := strings.TrimSpace(renderInlines(n))
+		return []mdBlock{{text: strings.Repeat("#", level) + " " + text}}
+	}
+	return renderBlocks(n)
+}
+
+// joinBlocks joins the texts of blocks with sep.
+func joinBlocks(blocks []mdBlock, sep string) string {
+	texts := make([]string, len(blocks))
+	for i, b := range blocks {
+		texts[i] = b.text
+	}
+	return strings.Join(texts, sep)
+}
+
+// renderCode renders a pre element as a fenced code block. A last line made
+// of backticks only is the closing fence being typed, which the upstream
+// shows as code until the block is complete; it is left out so that the
+// fence does not appear twice.
+func renderCode(n *html.Node) mdBlock {
+	code := strings.TrimRight(textContent(n), "\n")
+	if i := strings.LastIndexByte(code, '\n'); strings.Trim(code[i+1:], "`") == "" {
+		code = code[:max(i, 0)]
+	}
+	fence := strings.Repeat("`", max(3, longestRun(code, '`')+1))
+	open := fence + codeLanguage(n)
+	if code != "" {
+		open += "\n" + code
+	}
+	return mdBlock{text: open + "\n" + fence, open: open}
+}
+
+// codeLanguage is the language of a code block from the class of its code
+// element, as in class="language-go".
+func codeLanguage(pre *html.Node) string {
+	for c := pre.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.Data != "code" {
+			continue
+		}
+		for _, class := range strings.Fields(attr(c, "class")) {
+			if lang, ok := strings.CutPrefix(class, "language-"); ok {
+				return lang
+			}
+		}
+	}
+	return ""
+}
+
+// renderList renders an ol or ul element. Items whose content is in
+// paragraphs are separated by blank lines, as in the source of a loose list.
+func renderList(n *html.Node) string {
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	var items []string
+	loose := false
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.Data != "li" {
+			continue
+		}
+		marker := "- "
+		if n.Data == "ol" {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		sep := "\n"
+		if hasChild(c, "p") {
+			sep, loose = "\n\n", true
+		}
+		lines := strings.Split(joinBlocks(renderBlocks(c), sep), "\n")
+		indent := strings.Repeat(" ", len(marker))
+		for i, line := range lines {
+			switch {
+			case i == 0:
+				lines[i] = marker + line
+			case line != "":
+				lines[i] = indent + line
+			}
+		}
+		items = append(items, strings.TrimRight(strings.Join(lines, "\n"), " "))
+	}
+	if loose {
+		return strings.Join(items, "\n\n")
+	}
+	return strings.Join(items, "\n")
+}
+
+// renderTable renders a table as a pipe table. The first row is the header.
+func renderTable(n *html.Node) string {
+	var rows [][]*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if c.Data != "tr" {
+				walk(c)
+				continue
+			}
+			var cells []*html.Node
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.Data == "th" || cell.Data == "td") {
+					cells = append(cells, cell)
+				}
+			}
+			rows = append(rows, cells)
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	row := func(cells []string) {
+		b.WriteString("|")
+		for _, cell := range cells {
+			b.WriteString(" " + cell + " |")
+		}
+	}
+	header := rows[0]
+	texts, aligns := make([]string, len(header)), make([]string, len(header))
+	for i, cell := range header {
+		texts[i] = cellText(cell)
+		switch attr(cell, "align") + strings.ReplaceAll(attr(cell, "style"), " ", "") {
+		case "left", "text-align:left;", "text-align:left":
+			aligns[i] = ":---"
+		case "center", "text-align:center;", "text-align:center":
+			aligns[i] = ":---:"
+		case "right", "text-align:right;", "text-align:right":
+			aligns[i] = "---:"
+		default:
+			aligns[i] = "---"
+		}
+	}
+	row(texts)
+	b.WriteString("\n")
+	row(aligns)
+	for _, cells := range rows[1:] {
+		texts := make([]string, len(header))
+		for i := range texts {
+			if i < len(cells) {
+				texts[i] = cellText(cells[i])
+			}
+		}
+		b.WriteString("\n")
+		row(texts)
+	}
+	return b.String()
+}
+
+// cellText is the content of a table cell on one line.
+func cellText(n *html.Node) string {
+	text := strings.ReplaceAll(renderInlines(n), "|", `\|`)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// renderInlines renders the children of n as inline content.
+func renderInlines(n *html.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(renderInline(c))
+	}
+	return b.String()
+}
+
+func renderInline(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	if n.Type != html.ElementNode {
+		return ""
+	}
+	switch n.Data {
+	case "code":
+		return codeSpan(textContent(n))
+	case "strong", "b":
+		return wrapInline(renderInlines(n), "**")
+	case "em", "i":
+		return wrapInline(renderInlines(n), "*")
+	case "del", "s", "strike":
+		return wrapInline(renderInlines(n), "~~")
+	case "a":
+		text, href := renderInlines(n), attr(n, "href")
+		if href == "" {
+			return text
+		}
+		return "[" + text + "](" + href + ")"
+	case "img":
+		return "![" + attr(n, "alt") + "](" + attr(n, "src") + ")"
+	case "br":
+		return "\n"
+	case "span":
+		// MathJax shows the source of a formula in a preview span until it
+		// has typeset the script after it.
+		if hasClass(n, "MathJax_Preview") {
+			return ""
+		}
+	case "script":
+		switch strings.ReplaceAll(attr(n, "type"), " ", "") {
+		case "math/tex":
+			return "$" + textContent(n) + "$"
+		case "math/tex;mode=display":
+			return "$$" + textContent(n) + "$$"
+		}
+		return ""
+	case "style":
+		return ""
+	}
+	return renderInlines(n)
+}
+
+// wrapInline puts the markers of an emphasis around text.
+func wrapInline(text, marker string) string {
+	if strings.TrimSpace(text) == "" {
+		return text
+	}
+	return marker + text + marker
+}
+
+// codeSpan renders s as inline code, with enough backticks around it for the
+// ones in it.
+func codeSpan(s string) string {
+	fence := strings.Repeat("`", longestRun(s, '`')+1)
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+// longestRun is the length of the longest run of c in s.
+func longestRun(s string, c byte) int {
+	longest, run := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != c {
+			run = 0
+			continue
+		}
+		run++
+		longest = max(longest, run)
+	}
+	return longest
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func hasChild(n *html.Node, tag string) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == tag {
+			return true
+		}
+	}
+	return false
+}
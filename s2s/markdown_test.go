@@ -0,0 +1,63 @@
+package s2s
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// TestDealRes converts the upstream answers in testdata/golden/*.html and
+// compares them with the Markdown in the .md file of the same name, which is
+// written by hand. Run with -update only after a deliberate change of the
+// conversion, and check the diff against the answers.
+func TestDealRes(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "golden", "*.html"))
+	if len(files) == 0 {
+		t.Fatal("no golden files")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := DealRes(string(input))
+			golden := strings.TrimSuffix(file, ".html") + ".md"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("DealRes(%s) =\n%s\nwant\n%s", file, got, want)
+			}
+		})
+	}
+}
+
+func TestDealResPartial(t *testing.T) {
+	cases := []struct{ in, md, rest string }{
+		{"<p>a</p>", "a", ""},
+		// The upstream shows an open code block as closed.
+		{"<p>a</p><pre><code>x\n</code></pre>", "a\n\n```\nx", "\n```"},
+		{"<pre><code>x\n``\n</code></pre>", "```\nx", "\n```"},
+		{"<pre><code class=\"language-go\"></code></pre>", "```go", "\n```"},
+		{"<pre><code>a ``` b</code></pre>", "````\na ``` b", "\n````"},
+		{"<pre><code>x</code></pre><p>b</p>", "```\nx\n```\n\nb", ""},
+	}
+	for _, c := range cases {
+		if md, rest := DealResPartial(c.in); md != c.md || rest != c.rest {
+			t.Errorf("DealResPartial(%q) = %q, %q, want %q, %q", c.in, md, rest, c.md, c.rest)
+		}
+	}
+}
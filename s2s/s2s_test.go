@@ -2,8 +2,8 @@ package s2s
 
 import (
 	"encoding/json"
-	"fmt"
 	"nixiang-gpt/def"
+	"reflect"
 	"testing"
 )
 
@@ -22,13 +22,12 @@ func TestExtractConversations(t *testing.T) {
 	var reqMessages def.OpenAIChatRequest
 	err := json.Unmarshal([]byte(reqMessagesJSON), &reqMessages)
 	if err != nil {
-		fmt.Println("Error unmarshaling JSON:", err)
-		return
+		t.Fatal(err)
 	}
 
-	// 提取并打印对话
 	conversations := ExtractConversations(reqMessages.Messages)
-	for _, conv := range conversations {
-		fmt.Println(conv)
+	want := [][]string{{"你好", "你好！有什么我可以帮忙的吗？"}, {"鲁迅为什么打周树人"}}
+	if !reflect.DeepEqual(conversations, want) {
+		t.Errorf("ExtractConversations = %q, want %q", conversations, want)
 	}
 }
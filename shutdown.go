@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is how long active requests may take to finish once the
+// server is asked to stop.
+var shutdownTimeout = 30 * time.Second
+
+// shutdownGrace is how long the requests cancelled at the shutdown deadline
+// get to write their error events.
+const shutdownGrace = 5 * time.Second
+
+// errShuttingDown is the cause of the cancellation of the requests still
+// running at the shutdown deadline.
+var errShuttingDown = &apiError{
+	status:  http.StatusServiceUnavailable,
+	typ:     "server_error",
+	code:    "server_shutting_down",
+	message: "the server is shutting down",
+}
+
+// shuttingDown reports whether ctx was cancelled because the server is
+// stopping, as opposed to the client going away.
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShuttingDown)
+}
+
+// nextEvent waits for the next event of a streamed answer. If the server
+// stops meanwhile, it returns an event carrying errShuttingDown for the
+// handler to end the stream with; if the client goes away, it returns false.
+func nextEvent(ctx context.Context, events <-chan choiceEvent) (choiceEvent, bool) {
+	select {
+	case ev := <-events:
+		return ev, true
+	case <-ctx.Done():
+		if shuttingDown(ctx) {
+			return choiceEvent{err: errShuttingDown}, true
+		}
+		return choiceEvent{}, false
+	}
+}
+
+// shutdown stops srv gracefully: it stops accepting connections and waits
+// up to shutdownTimeout for active requests to finish. Requests still running
+// then are cancelled through cancel, which makes streams end with an error
+// event, and get shutdownGrace to write it before their connections are
+// closed. Finally, once their upstream sessions have said goodbye, or
+// shutdownGrace later, the warm upstream connections are closed; sessions
+// that would start after that fail instead.
+func shutdown(srv *http.Server, cancel context.CancelCauseFunc) {
+	deadline := time.AfterFunc(shutdownTimeout, func() {
+		slog.Warn("cancelling requests still running", "timeout", shutdownTimeout)
+		cancel(errShuttingDown)
+	})
+	defer deadline.Stop()
+	ctx, stop := context.WithTimeout(context.Background(), shutdownTimeout+shutdownGrace)
+	defer stop()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("closing connections", "error", err)
+		srv.Close()
+	}
+	cancel(errShuttingDown)
+
+	select {
+	case <-sessions.close():
+	case <-time.After(shutdownGrace):
+		slog.Warn("upstream sessions still open", "grace", shutdownGrace)
+	}
+	closePools()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShutdownCancelsStreams(t *testing.T) {
+	f := useFakeUpstream(t, "Hel", "Hello")
+	f.fail(fakeStall)
+	timeout := shutdownTimeout
+	t.Cleanup(func() { shutdownTimeout, sessions = timeout, &sessionSet{} })
+	shutdownTimeout = 50 * time.Millisecond
+
+	base, cancel := context.WithCancelCause(context.Background())
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.BaseContext = func(net.Listener) context.Context { return base }
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	// Wait for the stream to start before shutting down.
+	buf := make([]byte, 1)
+	if _, err := resp.Body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown(srv.Config, cancel)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := sseData(string(buf) + string(body))
+	if len(data) == 0 {
+		t.Fatalf("empty stream")
+	}
+	var last def.OpenAIErrorResponse
+	if err := json.Unmarshal([]byte(data[len(data)-1]), &last); err != nil || last.Error.Code != "server_shutting_down" {
+		t.Errorf("stream ended with %s, want a server_shutting_down error", data[len(data)-1])
+	}
+
+	// The upstream has been told the connection is going away by the time
+	// shutdown returns.
+	f.sessions.Wait()
+	f.mu.Lock()
+	closes := f.closes
+	f.mu.Unlock()
+	if len(closes) != 1 || closes[0] != websocket.CloseGoingAway {
+		t.Errorf("upstream received close frames %v", closes)
+	}
+	if got := testutil.ToFloat64(upstreamSessions); got != 0 {
+		t.Errorf("%v upstream sessions still open", got)
+	}
+}
+
+func TestSessionsAfterShutdown(t *testing.T) {
+	t.Cleanup(func() { sessions = &sessionSet{} })
+	if !sessions.add() {
+		t.Fatal("open set refused a session")
+	}
+	idle := sessions.close()
+	select {
+	case <-idle:
+		t.Fatal("closed set idle with a session running")
+	default:
+	}
+
+	// A choice that would start now fails instead.
+	choices := startChoices(context.Background())
+	defer choices.stop()
+	events := make(chan choiceEvent)
+	choices.stream(1, Prompt{}, limits{}, events)
+	if ev := <-events; ev.index != 1 || ev.err != errShuttingDown {
+		t.Errorf("choice started after shutdown: %+v", ev)
+	}
+
+	sessions.done()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Error("closed set not idle once its sessions are done")
+	}
+}
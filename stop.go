@@ -0,0 +1,59 @@
+package main
+
+import "strings"
+
+// stopScanner enforces stop sequences on a stream of deltas. The upstream has
+// no stop parameter, so the answer is cut locally; the tail of the buffered
+// text that could still be the beginning of a stop sequence split across two
+// deltas is held back until the next delta decides it.
+type stopScanner struct {
+	stops   []string
+	pending string
+	// matched is the stop sequence that ended the stream, if any.
+	matched string
+}
+
+// push returns the text that is safe to emit and whether a stop sequence has
+// been reached. After a match the rest of the stream must be discarded.
+func (s *stopScanner) push(delta string) (string, bool) {
+	buf := s.pending + delta
+	if text, stop := truncateAtStop(buf, s.stops); stop != "" {
+		s.pending = ""
+		s.matched = stop
+		return text, true
+	}
+
+	hold := 0
+	for _, stop := range s.stops {
+		for n := len(stop) - 1; n > hold; n-- {
+			if strings.HasSuffix(buf, stop[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	s.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// flush returns the held back text at the end of the stream.
+func (s *stopScanner) flush() string {
+	text := s.pending
+	s.pending = ""
+	return text
+}
+
+// truncateAtStop cuts text at the earliest stop sequence and returns the
+// sequence found, or "" if there is none.
+func truncateAtStop(text string, stops []string) (string, string) {
+	cut, matched := -1, ""
+	for _, stop := range stops {
+		if idx := strings.Index(text, stop); idx >= 0 && (cut < 0 || idx < cut) {
+			cut, matched = idx, stop
+		}
+	}
+	if cut < 0 {
+		return text, ""
+	}
+	return text[:cut], matched
+}
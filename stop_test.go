@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStopScanner(t *testing.T) {
+	cases := []struct {
+		stops  []string
+		deltas []string
+		want   string
+		hit    bool
+	}{
+		{[]string{"END"}, []string{"hello ", "world"}, "hello world", false},
+		{[]string{"END"}, []string{"hello E", "N", "D world"}, "hello ", true},
+		{[]string{"\n\n", "停止"}, []string{"第一行\n", "\n第二行"}, "第一行", true},
+		{[]string{"停止"}, []string{"可以停", "止了"}, "可以", true},
+		{[]string{"abc"}, []string{"ab", "ab", "x"}, "ababx", false},
+		{[]string{"xyz", "y"}, []string{"axy"}, "ax", true},
+	}
+	for _, c := range cases {
+		s := stopScanner{stops: c.stops}
+		var out strings.Builder
+		hit := false
+		for _, d := range c.deltas {
+			text, stopped := s.push(d)
+			out.WriteString(text)
+			if stopped {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			out.WriteString(s.flush())
+		}
+		if out.String() != c.want || hit != c.hit {
+			t.Errorf("stops %q deltas %q: got %q (stopped %v), want %q (stopped %v)",
+				c.stops, c.deltas, out.String(), hit, c.want, c.hit)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"nixiang-gpt/def"
+	"nixiang-gpt/s2s"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// mdStream converts the cumulative HTML snapshots sent by the upstream into
+// incremental Markdown deltas. The end of a snapshot may still change in the
+// next one, when it was cut inside a tag, an entity or an emphasis, so a
+// snapshot's Markdown is only sent as far as the next snapshot agrees with it.
+type mdStream struct {
+	lastResponse string
+	// rest is what the last snapshot holds back at its end, the closing
+	// fence of an open code block.
+	rest string
+	// sent is the Markdown sent so far, as of the last snapshot that
+	// extended it.
+	sent string
+}
+
+func (s *mdStream) next(msg string) string {
+	latestResponse, rest := s2s.DealResPartial(msg)
+	stable := latestResponse[:commonPrefix(s.lastResponse, latestResponse)]
+	s.lastResponse, s.rest = latestResponse, rest
+	return s.advance(stable)
+}
+
+// end returns what is left of the last snapshot, once it is known to be the
+// final one.
+func (s *mdStream) end() string {
+	delta := s.advance(s.lastResponse + s.rest)
+	s.rest = ""
+	return delta
+}
+
+// advance sends stable as far as it goes beyond sent. Sent text cannot be
+// taken back: if stable disagrees with it, as when a list turns loose or a
+// line turns into a heading, the deltas go on from where the two part, and
+// they no longer add up to the conversion of the final snapshot.
+func (s *mdStream) advance(stable string) string {
+	if strings.HasPrefix(s.sent, stable) {
+		return ""
+	}
+	delta := stable[commonPrefix(s.sent, stable):]
+	s.sent = stable
+	return delta
+}
+
+// commonPrefix is the length of the longest common prefix of a and b that
+// does not end inside a rune.
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	for n > 0 && n < len(b) && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return n
+}
+
+// limits are the caller's constraints on the length of an answer.
+type limits struct {
+	stops     []string
+	maxTokens int
+}
+
+// answer turns the upstream snapshots of one answer into Markdown deltas and
+// applies the stop sequences and the token limit.
+type answer struct {
+	conv  mdStream
+	stop  stopScanner
+	limit tokenLimiter
+}
+
+func newAnswer(lim limits) *answer {
+	return &answer{
+		stop:  stopScanner{stops: lim.stops},
+		limit: tokenLimiter{max: lim.maxTokens},
+	}
+}
+
+// push returns the next delta. A non-empty finish reason means the answer has
+// ended early and the upstream session should be aborted.
+func (a *answer) push(msg string) (string, string) {
+	delta, stopped := a.stop.push(a.conv.next(msg))
+	delta, limited := a.limit.push(delta)
+	switch {
+	case limited:
+		return delta, "length"
+	case stopped:
+		return delta, "stop"
+	}
+	return delta, ""
+}
+
+// flush returns the remaining text once the upstream has completed.
+func (a *answer) flush() (string, string) {
+	delta, stopped := a.stop.push(a.conv.end())
+	if !stopped {
+		delta += a.stop.flush()
+	}
+	delta, limited := a.limit.push(delta)
+	if limited {
+		return delta, "length"
+	}
+	return delta, "stop"
+}
+
+// tokens is the number of completion tokens emitted so far.
+func (a *answer) tokens() int {
+	return a.limit.used
+}
+
+// stopSequence is the stop sequence that ended the answer, if any.
+func (a *answer) stopSequence() string {
+	return a.stop.matched
+}
+
+// promptResult is the complete answer of one upstream exchange.
+type promptResult struct {
+	text         string
+	finishReason string
+	stopSequence string
+	tokens       int
+	attempts     int
+}
+
+// runPrompt performs one upstream exchange and returns the whole answer as
+// Markdown.
+func runPrompt(ctx context.Context, prompt Prompt, lim limits) (promptResult, error) {
+	events := make(chan choiceEvent)
+	choices := startChoices(ctx)
+	defer choices.stop()
+	choices.stream(0, prompt, lim, events)
+
+	var content strings.Builder
+	for {
+		select {
+		case ev := <-events:
+			if ev.err != nil {
+				return promptResult{}, ev.err
+			}
+			content.WriteString(ev.delta)
+			if ev.finishReason != "" {
+				return promptResult{
+					text:         content.String(),
+					finishReason: ev.finishReason,
+					stopSequence: ev.stopSequence,
+					tokens:       ev.tokens,
+					attempts:     ev.attempts,
+				}, nil
+			}
+		case <-ctx.Done():
+			return promptResult{}, context.Cause(ctx)
+		}
+	}
+}
+
+// firstEvent waits for the first event of a streamed answer that needs to be
+// written, so that a failure before any output can still be reported with a
+// proper HTTP status. Queue positions are held back until the request has
+// waited for queueHeartbeat, and then the latest one is returned. Like
+// nextEvent, it turns a shutdown into an error event.
+func firstEvent(ctx context.Context, events <-chan choiceEvent) (choiceEvent, bool) {
+	timer := time.NewTimer(queueHeartbeat)
+	defer timer.Stop()
+	var queued *choiceEvent
+	due := false
+	for {
+		select {
+		case ev := <-events:
+			if ev.queued == nil || due {
+				return ev, true
+			}
+			queued = &ev
+		case <-timer.C:
+			if queued != nil {
+				return *queued, true
+			}
+			due = true
+		case <-ctx.Done():
+			if shuttingDown(ctx) {
+				return choiceEvent{err: errShuttingDown}, true
+			}
+			return choiceEvent{}, false
+		}
+	}
+}
+
+// chunkWriter writes chat.completion.chunk events to an SSE response.
+type chunkWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	id      string
+	created int64
+	model   string
+}
+
+func newChunkWriter(w http.ResponseWriter, model string) (*chunkWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	return &chunkWriter{
+		w:       w,
+		flusher: flusher,
+		id:      newCompletionID(),
+		created: time.Now().Unix(),
+		model:   model,
+	}, true
+}
+
+func (cw *chunkWriter) send(choices ...def.OpenAIChatChoice) {
+	response := def.OpenAIChatResponse{
+		ID:      cw.id,
+		Object:  "chat.completion.chunk",
+		Created: cw.created,
+		Model:   cw.model,
+		Choices: choices,
+	}
+	data, _ := json.Marshal(response)
+	fmt.Fprintf(cw.w, "data: %s\n\n", data)
+	cw.flusher.Flush()
+}
+
+func (cw *chunkWriter) finish(index int, reason string) {
+	cw.send(def.OpenAIChatChoice{Index: index, FinishReason: &reason})
+}
+
+func (cw *chunkWriter) usage(usage def.OpenAIUsage) {
+	response := def.OpenAIChatResponse{
+		ID:      cw.id,
+		Object:  "chat.completion.chunk",
+		Created: cw.created,
+		Model:   cw.model,
+		Choices: []def.OpenAIChatChoice{},
+		Usage:   &usage,
+	}
+	data, _ := json.Marshal(response)
+	fmt.Fprintf(cw.w, "data: %s\n\n", data)
+	cw.flusher.Flush()
+}
+
+func (cw *chunkWriter) done() {
+	fmt.Fprint(cw.w, "data: [DONE]\n\n")
+	cw.flusher.Flush()
+}
+
+func newCompletionID() string {
+	return "chatcmpl-" + shortuuid.New()
+}
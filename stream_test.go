@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"nixiang-gpt/s2s"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// TestMDStream feeds the upstream snapshots in testdata/streams/*.json through
+// mdStream one by one. The concatenated deltas must equal both the conversion
+// of the final snapshot on its own and the hand-written Markdown in the .md
+// file of the same name; run with -update only after a deliberate change of
+// the conversion, and check the diff.
+func TestMDStream(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "streams", "*.json"))
+	if len(files) == 0 {
+		t.Fatal("no streams")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var frames []string
+			if err := json.Unmarshal(data, &frames); err != nil {
+				t.Fatal(err)
+			}
+
+			var conv mdStream
+			var deltas strings.Builder
+			for _, frame := range frames {
+				deltas.WriteString(conv.next(frame))
+			}
+			deltas.WriteString(conv.end())
+			got := deltas.String()
+			if whole := s2s.DealRes(frames[len(frames)-1]); got != whole {
+				t.Errorf("deltas add up to\n%s\nbut the final snapshot converts to\n%s", got, whole)
+			}
+
+			golden := strings.TrimSuffix(file, ".json") + ".md"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("stream %s =\n%s\nwant\n%s", file, got, want)
+			}
+		})
+	}
+}
+
+// FuzzMDStream streams an answer as three snapshots, the first two cut short
+// at arbitrary runes, which may be inside a tag or an entity. Deltas must be
+// valid UTF-8, and they must add up to the conversion of the final snapshot
+// unless the snapshots disagreed on Markdown that had been sent, as
+// mdStream.advance documents. The deltas of a plain text answer must add up
+// to the answer.
+func FuzzMDStream(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "streams", "*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		var frames []string
+		if err := json.Unmarshal(data, &frames); err != nil {
+			f.Fatal(err)
+		}
+		final := frames[len(frames)-1]
+		f.Add(final, len(final)/3, 2*len(final)/3)
+	}
+	f.Add("你好，世界", 4, 9)
+	f.Add("<p>a &amp; b</p>", 8, 12)
+	f.Fuzz(func(t *testing.T, answer string, cut1, cut2 int) {
+		if !utf8.ValidString(answer) {
+			return
+		}
+		cut := func(i int) int {
+			if i < 0 || i > len(answer) {
+				i = len(answer)
+			}
+			for i > 0 && i < len(answer) && !utf8.RuneStart(answer[i]) {
+				i--
+			}
+			return i
+		}
+		cut1, cut2 = cut(cut1), cut(cut2)
+		if cut1 > cut2 {
+			cut1, cut2 = cut2, cut1
+		}
+		frames := []string{answer[:cut1], answer[:cut2], answer}
+
+		var conv mdStream
+		var deltas strings.Builder
+		for _, frame := range frames {
+			delta := conv.next(frame)
+			if !utf8.ValidString(delta) {
+				t.Fatalf("delta %q of %q is not valid UTF-8", delta, frame)
+			}
+			deltas.WriteString(delta)
+		}
+		deltas.WriteString(conv.end())
+
+		whole := s2s.DealRes(answer)
+		agreed, last := true, ""
+		for _, frame := range frames {
+			md, _ := s2s.DealResPartial(frame)
+			agreed = agreed && strings.HasPrefix(whole, md[:commonPrefix(last, md)])
+			last = md
+		}
+		if agreed && deltas.String() != whole {
+			t.Errorf("deltas add up to %q, but the final snapshot converts to %q", deltas.String(), whole)
+		}
+		// The HTML parser drops leading white space and rewrites carriage
+		// returns and NULs.
+		if !strings.ContainsAny(answer, "<>&`\r\x00") {
+			want := strings.TrimRight(strings.TrimLeft(answer, " \t\n\f"), "\n")
+			if deltas.String() != want {
+				t.Errorf("deltas add up to %q, want %q", deltas.String(), want)
+			}
+		}
+	})
+}
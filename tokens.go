@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// countTokens estimates the number of tokens in s. There is no tokenizer for
+// the upstream models, so this approximates cl100k: a CJK character is about
+// one token, a run of ASCII letters or digits is one token per four bytes and
+// any other symbol counts as one. Whitespace is folded into the next token.
+func countTokens(s string) int {
+	return countTokensAfter(0, s)
+}
+
+// countTokensAfter counts the tokens of s when it follows a run of word bytes
+// of the given length.
+func countTokensAfter(word int, s string) int {
+	tokens := 0
+	endWord := func() {
+		tokens += (word + 3) / 4
+		word = 0
+	}
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			word++
+		case unicode.IsSpace(r):
+			endWord()
+		default:
+			endWord()
+			tokens++
+		}
+	}
+	endWord()
+	return tokens
+}
+
+// tokenLimiter cuts a delta stream once max tokens have been produced. A max
+// of zero disables the limit.
+//
+// Tokens are counted as the deltas come: everything up to the last word
+// boundary is counted once and for all, only the word still being written
+// carries over into the next delta.
+type tokenLimiter struct {
+	max  int
+	used int
+	// done counts the tokens before the trailing run of tail word bytes.
+	done int
+	tail int
+}
+
+// push returns the part of delta that fits into the limit and whether the
+// limit has been reached.
+func (l *tokenLimiter) push(delta string) (string, bool) {
+	if l.max > 0 && l.done+countTokensAfter(l.tail, delta) > l.max {
+		// Find the longest prefix of delta, on a rune boundary, that still
+		// fits.
+		var cuts []int
+		for i := range delta {
+			cuts = append(cuts, i)
+		}
+		cuts = append(cuts, len(delta))
+		n := sort.Search(len(cuts), func(i int) bool {
+			return l.done+countTokensAfter(l.tail, delta[:cuts[i]]) > l.max
+		})
+		cut := 0
+		if n > 0 {
+			cut = cuts[n-1]
+		}
+		l.add(delta[:cut])
+		return delta[:cut], true
+	}
+	l.add(delta)
+	return delta, false
+}
+
+// add counts delta in.
+func (l *tokenLimiter) add(delta string) {
+	split := len(delta)
+	for split > 0 && isWordByte(delta[split-1]) {
+		split--
+	}
+	if split > 0 {
+		// A word boundary ends the count of what comes before it.
+		l.done += countTokensAfter(l.tail, delta[:split])
+		l.tail = 0
+	}
+	l.tail += len(delta) - split
+	l.used = l.done + (l.tail+3)/4
+}
+
+// isWordByte reports whether b belongs to a run that countTokens counts by
+// its length.
+func isWordByte(b byte) bool {
+	return b < utf8.RuneSelf && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)))
+}
+
+// promptTokens estimates the prompt size of an upstream exchange.
+func promptTokens(prompt Prompt) int {
+	n := countTokens(prompt.SystemPrompt) + countTokens(prompt.Message)
+	for _, turn := range prompt.History {
+		for _, text := range turn {
+			n += countTokens(text)
+		}
+	}
+	return n
+}
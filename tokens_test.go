@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountTokens(t *testing.T) {
+	cases := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello world", 4},
+		{"你好，世界", 5},
+		{"a = b + 1;", 6},
+	}
+	for _, c := range cases {
+		if got := countTokens(c.text); got != c.want {
+			t.Errorf("countTokens(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+}
+
+func TestTokenLimiter(t *testing.T) {
+	l := tokenLimiter{max: 5}
+	var out strings.Builder
+	for _, delta := range []string{"你好", "，世", "界！再见"} {
+		text, limited := l.push(delta)
+		out.WriteString(text)
+		if limited {
+			break
+		}
+	}
+	if out.String() != "你好，世界" || l.used != 5 {
+		t.Errorf("got %q (%d tokens)", out.String(), l.used)
+	}
+
+	unlimited := tokenLimiter{}
+	if text, limited := unlimited.push("anything at all"); limited || text != "anything at all" {
+		t.Errorf("unlimited: got %q, %v", text, limited)
+	}
+}
+
+func TestTokenLimiterIncremental(t *testing.T) {
+	// However the text is split into deltas, the count matches the count of
+	// the whole text.
+	text := []rune("Hello, wonderful world! 你好，世界。 x = y+1; internationalization")
+	for size := 1; size <= 7; size++ {
+		l := tokenLimiter{}
+		for i := 0; i < len(text); i += size {
+			end := i + size
+			if end > len(text) {
+				end = len(text)
+			}
+			l.push(string(text[i:end]))
+		}
+		if want := countTokens(string(text)); l.used != want {
+			t.Errorf("deltas of %d bytes: %d tokens, want %d", size, l.used, want)
+		}
+	}
+
+	l := tokenLimiter{max: 3}
+	var out strings.Builder
+	for _, delta := range []string{"abc", "defgh", "ijkl", "mnop"} {
+		text, limited := l.push(delta)
+		out.WriteString(text)
+		if limited {
+			break
+		}
+	}
+	if out.String() != "abcdefghijkl" || l.used != 3 {
+		t.Errorf("got %q (%d tokens)", out.String(), l.used)
+	}
+}
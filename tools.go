@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"nixiang-gpt/def"
+	"strings"
+
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// The upstream only produces free text, so tool calls are emulated: the tool
+// schemas go into the system prompt and the model is asked to answer with
+// toolCallMarker lines that are parsed back out of the converted Markdown.
+const (
+	toolCallMarker   = "TOOL_CALL:"
+	toolResultMarker = "TOOL_RESULT"
+)
+
+// toolPrompt renders the tool instructions for the system prompt. It returns
+// "" when tools are absent or disabled by tool_choice "none".
+func toolPrompt(tools []def.OpenAITool, toolChoice json.RawMessage) (string, error) {
+	if len(tools) == 0 {
+		return "", nil
+	}
+
+	var requirement string
+	if len(toolChoice) > 0 && string(toolChoice) != "null" {
+		var mode string
+		if err := json.Unmarshal(toolChoice, &mode); err == nil {
+			switch mode {
+			case "none":
+				return "", nil
+			case "auto":
+			case "required":
+				requirement = "You MUST call at least one tool."
+			default:
+				return "", fmt.Errorf("unsupported tool_choice %q", mode)
+			}
+		} else {
+			var named def.OpenAITool
+			if err := json.Unmarshal(toolChoice, &named); err != nil || named.Function.Name == "" {
+				return "", fmt.Errorf("invalid tool_choice")
+			}
+			requirement = fmt.Sprintf("You MUST call the tool %q.", named.Function.Name)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("You have access to the following tools:\n\n")
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			return "", fmt.Errorf("unsupported tool type %q", tool.Type)
+		}
+		fmt.Fprintf(&b, "- %s", tool.Function.Name)
+		if tool.Function.Description != "" {
+			fmt.Fprintf(&b, ": %s", tool.Function.Description)
+		}
+		b.WriteString("\n")
+		if len(tool.Function.Parameters) > 0 {
+			fmt.Fprintf(&b, "  parameters (JSON schema): %s\n", compactJSON(tool.Function.Parameters))
+		}
+	}
+	b.WriteString("\nTo call a tool, reply with one line per call in exactly this format and nothing else:\n")
+	b.WriteString(toolCallMarker + ` {"name": "<tool name>", "arguments": {<arguments as a JSON object>}}` + "\n")
+	b.WriteString("Tool results will be sent back to you in lines starting with " + toolResultMarker + ". ")
+	b.WriteString("If no tool is needed, answer normally without any " + toolCallMarker + " line.")
+	if requirement != "" {
+		b.WriteString("\n" + requirement)
+	}
+	return b.String(), nil
+}
+
+// parseToolCalls extracts the tool calls from a converted answer and returns
+// the remaining text.
+func parseToolCalls(text string) (string, []def.OpenAIToolCall) {
+	var calls []def.OpenAIToolCall
+	var rest strings.Builder
+	for {
+		idx := strings.Index(text, toolCallMarker)
+		if idx < 0 {
+			rest.WriteString(text)
+			break
+		}
+		rest.WriteString(text[:idx])
+		body := strings.TrimLeft(text[idx+len(toolCallMarker):], " \t`")
+
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		dec := json.NewDecoder(strings.NewReader(body))
+		if err := dec.Decode(&call); err != nil || call.Name == "" {
+			// Not a well-formed call; keep the marker as plain text.
+			rest.WriteString(toolCallMarker)
+			text = text[idx+len(toolCallMarker):]
+			continue
+		}
+		arguments := "{}"
+		if len(call.Arguments) > 0 && string(call.Arguments) != "null" {
+			arguments = compactJSON(call.Arguments)
+		}
+		calls = append(calls, def.OpenAIToolCall{
+			ID:       "call_" + shortuuid.New(),
+			Type:     "function",
+			Function: def.OpenAIFunctionCall{Name: call.Name, Arguments: arguments},
+		})
+		text = strings.TrimLeft(body[dec.InputOffset():], " \t`")
+	}
+	return strings.TrimSpace(stripEmptyFences(rest.String())), calls
+}
+
+// stripEmptyFences removes code fences left empty once the calls inside them
+// have been cut out.
+func stripEmptyFences(text string) string {
+	for _, fence := range []string{"```json\n", "```\n"} {
+		from := 0
+		for {
+			idx := strings.Index(text[from:], fence)
+			if idx < 0 {
+				break
+			}
+			idx += from
+			trimmed := strings.TrimLeft(text[idx+len(fence):], " \t\n")
+			if !strings.HasPrefix(trimmed, "```") {
+				from = idx + len(fence)
+				continue
+			}
+			text = text[:idx] + strings.TrimPrefix(trimmed, "```")
+			from = idx
+		}
+	}
+	return text
+}
+
+// flattenToolMessages rewrites assistant tool calls and tool results as plain
+// text turns, so they survive s2s.ExtractConversations as history.
+func flattenToolMessages(messages []def.OpenAIChatMessage) []def.OpenAIChatMessage {
+	var out []def.OpenAIChatMessage
+	for _, m := range messages {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(m.Content)
+			for _, call := range m.ToolCalls {
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+				arguments := call.Function.Arguments
+				if !json.Valid([]byte(arguments)) {
+					arguments = "{}"
+				}
+				fmt.Fprintf(&b, `%s {"name": %q, "arguments": %s}`, toolCallMarker, call.Function.Name, arguments)
+			}
+			out = append(out, def.OpenAIChatMessage{Role: "assistant", Content: b.String()})
+		case m.Role == "tool" || m.Role == "function":
+			label := strings.TrimSpace(m.Name + " " + m.ToolCallID)
+			result := fmt.Sprintf("%s (%s): %s", toolResultMarker, label, m.Content)
+			// Consecutive results belong to the same turn.
+			if n := len(out); n > 0 && out[n-1].Role == "user" && strings.HasPrefix(out[n-1].Content, toolResultMarker) {
+				out[n-1].Content += "\n" + result
+				continue
+			}
+			out = append(out, def.OpenAIChatMessage{Role: "user", Content: result})
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func compactJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"nixiang-gpt/def"
+	"strings"
+	"testing"
+)
+
+func TestParseToolCalls(t *testing.T) {
+	text := "I'll check the weather.\n```\n" +
+		`TOOL_CALL: {"name": "get_weather", "arguments": {"city": "北京", "unit": "c"}}` + "\n" +
+		`TOOL_CALL: {"name": "get_time"}` + "\n```"
+	rest, calls := parseToolCalls(text)
+	if rest != "I'll check the weather." {
+		t.Errorf("rest: got %q", rest)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(calls))
+	}
+	if calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city":"北京","unit":"c"}` {
+		t.Errorf("call 0: got %+v", calls[0].Function)
+	}
+	if calls[1].Function.Name != "get_time" || calls[1].Function.Arguments != "{}" {
+		t.Errorf("call 1: got %+v", calls[1].Function)
+	}
+	if !strings.HasPrefix(calls[0].ID, "call_") || calls[0].Type != "function" {
+		t.Errorf("call 0: got id %q type %q", calls[0].ID, calls[0].Type)
+	}
+
+	rest, calls = parseToolCalls("Use TOOL_CALL: to call tools.")
+	if len(calls) != 0 || rest != "Use TOOL_CALL: to call tools." {
+		t.Errorf("plain text: got %q %+v", rest, calls)
+	}
+}
+
+func TestToolPrompt(t *testing.T) {
+	tools := []def.OpenAITool{{
+		Type: "function",
+		Function: def.OpenAIFunction{
+			Name:        "get_weather",
+			Description: "Get the weather",
+			Parameters:  json.RawMessage(`{"type": "object"}`),
+		},
+	}}
+	prompt, err := toolPrompt(tools, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, "- get_weather: Get the weather") || !strings.Contains(prompt, `{"type":"object"}`) {
+		t.Errorf("unexpected prompt:\n%s", prompt)
+	}
+	if prompt, _ := toolPrompt(tools, json.RawMessage(`"none"`)); prompt != "" {
+		t.Errorf("tool_choice none: got %q", prompt)
+	}
+	prompt, err = toolPrompt(tools, json.RawMessage(`{"type":"function","function":{"name":"get_weather"}}`))
+	if err != nil || !strings.Contains(prompt, `You MUST call the tool "get_weather".`) {
+		t.Errorf("named tool_choice: got %q, %v", prompt, err)
+	}
+}
+
+func TestFlattenToolMessages(t *testing.T) {
+	messages := flattenToolMessages([]def.OpenAIChatMessage{
+		{Role: "user", Content: "weather?"},
+		{Role: "assistant", ToolCalls: []def.OpenAIToolCall{{
+			ID:       "call_1",
+			Function: def.OpenAIFunctionCall{Name: "get_weather", Arguments: `{"city":"北京"}`},
+		}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+		{Role: "tool", ToolCallID: "call_2", Content: "25C"},
+	})
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %+v", messages)
+	}
+	if messages[1].Content != `TOOL_CALL: {"name": "get_weather", "arguments": {"city":"北京"}}` {
+		t.Errorf("assistant turn: got %q", messages[1].Content)
+	}
+	if messages[2].Role != "user" || messages[2].Content != "TOOL_RESULT (call_1): sunny\nTOOL_RESULT (call_2): 25C" {
+		t.Errorf("tool turn: got %+v", messages[2])
+	}
+}
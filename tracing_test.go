@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	useFakeUpstream(t, "Hel", "Hello")
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	defer func(p propagation.TextMapPropagator) { otel.SetTextMapPropagator(p) }(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// The first provider set stays the delegate of tracer for good.
+	otel.SetTracerProvider(tp)
+	defer tp.Shutdown(context.Background())
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	ended := spans.Ended()
+	parents := map[string]string{}
+	names := map[string]string{}
+	for _, s := range ended {
+		if got := s.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q in trace %s, want %s", s.Name(), got, traceID)
+		}
+		names[s.SpanContext().SpanID().String()] = s.Name()
+		parents[s.Name()] = s.Parent().SpanID().String()
+	}
+	for span, parent := range map[string]string{
+		"POST /v1/chat/completions": "",
+		"extract conversation":      "POST /v1/chat/completions",
+		"upstream dial":             "POST /v1/chat/completions",
+		"upstream session":          "POST /v1/chat/completions",
+		"queue join":                "upstream session",
+		"send_hash":                 "queue join",
+		"queue wait":                "upstream session",
+		"send_data":                 "queue wait",
+		"generation":                "upstream session",
+		"conversion":                "upstream session",
+	} {
+		id, ok := parents[span]
+		if !ok {
+			t.Errorf("no span %q", span)
+			continue
+		}
+		if names[id] != parent {
+			t.Errorf("span %q has parent %q, want %q", span, names[id], parent)
+		}
+	}
+}
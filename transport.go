@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"nixiang-gpt/def"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transport carries the messages of the Gradio queue protocol.
+type transport interface {
+	// join puts the request into the queue. Over websockets the server asks
+	// for it with send_data instead, so join has nothing to do there.
+	join(ctx context.Context, req def.AiRequest) error
+	// send answers a message of the server.
+	send(ctx context.Context, v interface{}) error
+	// receive returns the next message of the server. It returns nil, nil
+	// when ctx is cancelled and errUpstreamTimeout after timeout, if timeout
+	// is non-zero.
+	receive(ctx context.Context, timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+// inbox hands the messages read by a transport's reader goroutine to
+// receive. Messages that arrived before the connection went away are still
+// delivered.
+type inbox struct {
+	frames chan []byte
+	// done is closed when the reader has stopped.
+	done chan struct{}
+	// closing is closed by the transport's Close, so a reader nobody
+	// listens to any more does not block forever.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		frames:  make(chan []byte, 256),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+}
+
+func (in *inbox) push(frame []byte) bool {
+	select {
+	case in.frames <- frame:
+		return true
+	case <-in.closing:
+		return false
+	}
+}
+
+func (in *inbox) close() {
+	in.closeOnce.Do(func() { close(in.closing) })
+}
+
+// closed reports whether the reader has stopped.
+func (in *inbox) closed() bool {
+	select {
+	case <-in.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (in *inbox) receive(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case msg := <-in.frames:
+		return msg, nil
+	case <-in.done:
+		select {
+		case msg := <-in.frames:
+			return msg, nil
+		default:
+			return nil, errConnectionClosed
+		}
+	case <-timer:
+		return nil, errUpstreamTimeout
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+// queueProtocol is a version of the Gradio queue protocol.
+type queueProtocol int
+
+const (
+	// protocolWebsocket is Gradio 3's queue over a websocket at /queue/join.
+	protocolWebsocket queueProtocol = iota
+	// protocolSSE is Gradio 4's queue: a POST to /queue/join and the
+	// messages of the session as server-sent events from /queue/data.
+	protocolSSE
+)
+
+func (p queueProtocol) String() string {
+	if p == protocolSSE {
+		return "sse"
+	}
+	return "ws"
+}
+
+// protocols caches the probed protocol of every upstream address, as a
+// probedProtocol.
+var protocols sync.Map
+
+// protocolFallbackTTL is how long the websocket protocol is assumed for an
+// upstream that could not be probed before it is probed again.
+const protocolFallbackTTL = 30 * time.Second
+
+type probedProtocol struct {
+	proto queueProtocol
+	// expires is set for a fallback.
+	expires time.Time
+}
+
+var probeClient = &http.Client{Timeout: waitTimeout}
+
+// probeProtocol finds the queue protocol of the upstream from its /config.
+// Upstreams that cannot be probed are assumed to speak the websocket protocol.
+func probeProtocol(addr string) (queueProtocol, error) {
+	if p, ok := protocols.Load(addr); ok {
+		if p := p.(probedProtocol); p.expires.IsZero() || time.Now().Before(p.expires) {
+			return p.proto, nil
+		}
+	}
+	// While the upstream is down, do not pay for a probe on every session.
+	fallback := func() (queueProtocol, error) {
+		protocols.Store(addr, probedProtocol{proto: protocolWebsocket, expires: time.Now().Add(protocolFallbackTTL)})
+		return protocolWebsocket, nil
+	}
+	base, err := httpBase(addr)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := probeClient.Get(base + "/config")
+	if err != nil {
+		slog.Warn("probing upstream protocol failed, assuming websocket", "addr", addr, "error", err)
+		return fallback()
+	}
+	defer resp.Body.Close()
+	var config def.GradioConfig
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&config) != nil {
+		slog.Warn("probing upstream protocol failed, assuming websocket", "addr", addr, "status", resp.Status)
+		return fallback()
+	}
+	proto, err := parseProtocol(config)
+	if err != nil {
+		return 0, err
+	}
+	protocols.Store(addr, probedProtocol{proto: proto})
+	return proto, nil
+}
+
+func parseProtocol(config def.GradioConfig) (queueProtocol, error) {
+	switch config.Protocol {
+	case "sse_v2", "sse_v2.1", "sse_v3":
+		return protocolSSE, nil
+	case "ws":
+		return protocolWebsocket, nil
+	case "":
+		// Gradio 3 did not announce its protocol.
+		major, _, _ := strings.Cut(config.Version, ".")
+		if v, err := strconv.Atoi(major); err == nil && v < 4 {
+			return protocolWebsocket, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported Gradio queue protocol %q (version %s)", config.Protocol, config.Version)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"nixiang-gpt/def"
+	"sync"
+	"time"
+)
+
+// maxEventSize bounds a single server-sent event. Completed messages carry
+// the whole chat history, so this is well above maxMessageSize.
+const maxEventSize = 4 << 20 // 4 MB
+
+// sseTransport speaks the Gradio 4 queue protocol: the request is posted to
+// /queue/join and the messages of the session are read from /queue/data.
+type sseTransport struct {
+	base        string
+	sessionHash string
+	*inbox
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+}
+
+func newSSETransport(base, sessionHash string) *sseTransport {
+	return &sseTransport{
+		base:        base,
+		sessionHash: sessionHash,
+		inbox:       newInbox(),
+		cancel:      func() {},
+	}
+}
+
+func (t *sseTransport) join(ctx context.Context, req def.AiRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	post, err := http.NewRequestWithContext(ctx, http.MethodPost, t.base+"/queue/join", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	post.Header.Set("Content-Type", "application/json")
+	resp, err := upstreamHTTP.Do(post)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return errQueueFull
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// The stream outlives join; Close ends it.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		cancel()
+		return errConnectionClosed
+	}
+	t.cancel = cancel
+	t.mu.Unlock()
+	get, err := http.NewRequestWithContext(streamCtx, http.MethodGet,
+		t.base+"/queue/data?session_hash="+url.QueryEscape(t.sessionHash), nil)
+	if err != nil {
+		return err
+	}
+	get.Header.Set("Accept", "text/event-stream")
+	resp, err = upstreamHTTP.Do(get)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("opening event stream: unexpected status %s", resp.Status)
+	}
+	go t.readStream(resp.Body)
+	return nil
+}
+
+func (t *sseTransport) send(ctx context.Context, v interface{}) error {
+	return errors.New("the SSE queue protocol takes no messages after joining")
+}
+
+// receive treats a stream that stays silent for longer than pongWait as dead;
+// Gradio sends a heartbeat every 15 seconds.
+func (t *sseTransport) receive(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		timeout = pongWait
+	}
+	return t.inbox.receive(ctx, timeout)
+}
+
+func (t *sseTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.cancel()
+	t.inbox.close()
+	return nil
+}
+
+// readStream pushes the data of every event of the stream to the inbox.
+func (t *sseTransport) readStream(body io.ReadCloser) {
+	defer func() {
+		body.Close()
+		close(t.done)
+	}()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if len(data) > 0 && !t.push(data) {
+				return
+			}
+			data = nil
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))...)
+		}
+	}
+	if len(data) > 0 {
+		t.push(data)
+	}
+}
+
+// applyOutputDiffs applies the diffs of a process_generating message to the
+// previous output. Every output has a list of [action, path, value] edits.
+func applyOutputDiffs(prev, diffs []interface{}) ([]interface{}, error) {
+	out := make([]interface{}, len(diffs))
+	for i, d := range diffs {
+		var value interface{}
+		if i < len(prev) {
+			value = prev[i]
+		}
+		edits, ok := d.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("malformed diff for output %d", i)
+		}
+		for _, e := range edits {
+			edit, ok := e.([]interface{})
+			if !ok || len(edit) != 3 {
+				return nil, fmt.Errorf("malformed diff for output %d", i)
+			}
+			action, _ := edit[0].(string)
+			path, _ := edit[1].([]interface{})
+			var err error
+			if value, err = applyEdit(value, action, path, edit[2]); err != nil {
+				return nil, fmt.Errorf("output %d: %w", i, err)
+			}
+		}
+		out[i] = value
+	}
+	return out, nil
+}
+
+// applyEdit performs one diff action at path inside target.
+func applyEdit(target interface{}, action string, path []interface{}, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		switch action {
+		case "replace":
+			return value, nil
+		case "append":
+			switch t := target.(type) {
+			case string:
+				s, ok := value.(string)
+				if !ok {
+					return nil, errors.New("appending a non-string to a string")
+				}
+				return t + s, nil
+			case []interface{}:
+				return append(t, value), nil
+			}
+			return nil, fmt.Errorf("cannot append to %T", target)
+		}
+		return nil, fmt.Errorf("unsupported diff action %q at the root", action)
+	}
+
+	switch t := target.(type) {
+	case []interface{}:
+		f, ok := path[0].(float64)
+		i := int(f)
+		if !ok || i < 0 || i > len(t) {
+			return nil, fmt.Errorf("diff index %v out of range", path[0])
+		}
+		if len(path) == 1 {
+			switch action {
+			case "add":
+				return append(t[:i], append([]interface{}{value}, t[i:]...)...), nil
+			case "delete":
+				if i == len(t) {
+					return nil, fmt.Errorf("diff index %d out of range", i)
+				}
+				return append(t[:i], t[i+1:]...), nil
+			}
+		}
+		if i == len(t) {
+			return nil, fmt.Errorf("diff index %d out of range", i)
+		}
+		v, err := applyEdit(t[i], action, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = v
+		return t, nil
+	case map[string]interface{}:
+		key, ok := path[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("diff key %v is not a string", path[0])
+		}
+		if len(path) == 1 {
+			switch action {
+			case "add":
+				t[key] = value
+				return t, nil
+			case "delete":
+				delete(t, key)
+				return t, nil
+			}
+		}
+		v, err := applyEdit(t[key], action, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[key] = v
+		return t, nil
+	}
+	return nil, fmt.Errorf("cannot follow diff path into %T", target)
+}
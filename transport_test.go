@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nixiang-gpt/def"
+)
+
+func TestParseProtocol(t *testing.T) {
+	cases := []struct {
+		config def.GradioConfig
+		want   queueProtocol
+		ok     bool
+	}{
+		{def.GradioConfig{Version: "3.32.0"}, protocolWebsocket, true},
+		{def.GradioConfig{Version: "3.50.2", Protocol: "ws"}, protocolWebsocket, true},
+		{def.GradioConfig{Version: "4.36.1", Protocol: "sse_v3"}, protocolSSE, true},
+		{def.GradioConfig{Version: "4.19.0", Protocol: "sse_v2.1"}, protocolSSE, true},
+		{def.GradioConfig{Version: "4.0.0", Protocol: "sse_v1"}, 0, false},
+		{def.GradioConfig{Version: "5.0.0"}, 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseProtocol(c.config)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("parseProtocol(%+v) = %v, %v", c.config, got, err)
+		}
+	}
+}
+
+func TestProbeProtocolFallback(t *testing.T) {
+	var probes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	addr := "ws" + strings.TrimPrefix(srv.URL, "http") + "/queue/join"
+	defer protocols.Delete(addr)
+
+	for i := 0; i < 3; i++ {
+		if proto, err := probeProtocol(addr); err != nil || proto != protocolWebsocket {
+			t.Fatalf("probeProtocol = %v, %v", proto, err)
+		}
+	}
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Errorf("upstream probed %d times, want once", n)
+	}
+
+	// Once the fallback expires, the upstream is probed again.
+	protocols.Store(addr, probedProtocol{proto: protocolWebsocket, expires: time.Now().Add(-time.Second)})
+	probeProtocol(addr)
+	if n := atomic.LoadInt32(&probes); n != 2 {
+		t.Errorf("upstream probed %d times, want twice", n)
+	}
+}
+
+func TestApplyOutputDiffs(t *testing.T) {
+	var prev, diffs, want []interface{}
+	json.Unmarshal([]byte(`[null, [["a", "x"]], {"k": 1}]`), &prev)
+	json.Unmarshal([]byte(`[
+		[],
+		[["append", [0, 1], "yz"], ["add", [1], ["b", ""]], ["replace", [1, 1], "w"]],
+		[["add", ["j"], 2], ["delete", ["k"], null]]
+	]`), &diffs)
+	json.Unmarshal([]byte(`[null, [["a", "xyz"], ["b", "w"]], {"j": 2}]`), &want)
+
+	got, err := applyOutputDiffs(prev, diffs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	json.Unmarshal([]byte(`[[], [["append", [5, 1], "x"]]]`), &diffs)
+	if _, err := applyOutputDiffs(prev, diffs); err == nil {
+		t.Error("out of range diff was accepted")
+	}
+}
+
+func TestSSETransport(t *testing.T) {
+	var joined def.AiRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/queue/join":
+			json.NewDecoder(r.Body).Decode(&joined)
+			fmt.Fprint(w, `{"event_id":"e1"}`)
+		case "/queue/data":
+			if r.URL.Query().Get("session_hash") != "s1" {
+				http.Error(w, "unknown session", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"msg\":\"estimation\"}\n\n: comment\n\ndata: {\"msg\":\n")
+			fmt.Fprint(w, "data: \"close_stream\"}\n\n")
+		}
+	}))
+	defer srv.Close()
+
+	tr := newSSETransport(srv.URL, "s1")
+	defer tr.Close()
+	ctx := context.Background()
+	if err := tr.join(ctx, def.AiRequest{FnIndex: 18, SessionHash: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	if joined.FnIndex != 18 || joined.SessionHash != "s1" {
+		t.Errorf("joined with %+v", joined)
+	}
+	for _, want := range []string{`{"msg":"estimation"}`, "{\"msg\":\n\"close_stream\"}"} {
+		frame, err := tr.receive(ctx, 0)
+		if err != nil || string(frame) != want {
+			t.Fatalf("receive = %q, %v, want %q", frame, err, want)
+		}
+	}
+	if _, err := tr.receive(ctx, 0); err != errConnectionClosed {
+		t.Errorf("receive after end of stream: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"nixiang-gpt/def"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsTransport speaks the Gradio 3 queue protocol over a websocket.
+type wsTransport struct {
+	conn *websocket.Conn
+	*inbox
+	// mu serialises writes, which the websocket does not allow concurrently.
+	mu      sync.Mutex
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func dialWebsocket(addr string) (*wsTransport, error) {
+	conn, _, err := wsDialer.Dial(addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	t := &wsTransport{
+		conn:    conn,
+		inbox:   newInbox(),
+		stopped: make(chan struct{}),
+	}
+
+	go t.readPump()
+	go t.writePump()
+
+	return t, nil
+}
+
+func (t *wsTransport) join(ctx context.Context, req def.AiRequest) error {
+	return nil
+}
+
+func (t *wsTransport) send(ctx context.Context, v interface{}) error {
+	marshal, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logger(ctx).Debug("upstream send", "payload", redacted(marshal))
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.TextMessage, marshal)
+}
+
+// Close says goodbye to the server before closing the connection, so that
+// Gradio drops the queue job instead of waiting for it to time out.
+func (t *wsTransport) Close() error {
+	t.once.Do(func() {
+		close(t.stopped)
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+		t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	})
+	t.inbox.close()
+	return t.conn.Close()
+}
+
+func (t *wsTransport) readPump() {
+	defer func() {
+		t.conn.Close()
+		close(t.done)
+	}()
+
+	t.conn.SetReadLimit(maxMessageSize)
+	t.conn.SetReadDeadline(time.Now().Add(pongWait))
+	t.conn.SetPongHandler(func(string) error {
+		t.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := t.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.Warn("upstream connection closed unexpectedly", "error", err)
+			}
+			break
+		}
+		if !t.push(message) {
+			break
+		}
+	}
+}
+
+// writePump keeps the connection alive with pings.
+func (t *wsTransport) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := t.conn.WriteMessage(websocket.PingMessage, nil)
+			t.mu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-t.stopped:
+			return
+		}
+	}
+}
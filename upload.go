@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"nixiang-gpt/def"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const maxImageSize = 20 << 20 // 20 MB
+
+// imageFetchTimeout bounds fetching an image URL.
+const imageFetchTimeout = 30 * time.Second
+
+// imageClient fetches image URLs. It refuses to connect to loopback, private
+// and link-local addresses, so that clients cannot reach the proxy's network
+// through it.
+var imageClient = newImageClient(false)
+
+func newImageClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		// Checking the address actually dialled also covers redirects and
+		// names resolving to internal addresses.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("image host %s is not a public address", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: imageFetchTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// checkImageSupport rejects requests carrying images for models that cannot
+// see them, and images anywhere but in the last user message, which is the
+// only one the upstream gets them for.
+func checkImageSupport(model string, messages []def.OpenAIChatMessage) error {
+	last := lastUserMessage(messages)
+	for i, m := range messages {
+		if len(m.Images) == 0 {
+			continue
+		}
+		if !supportsVision(model) {
+			return fmt.Errorf("model %q does not support image input", model)
+		}
+		if i != last {
+			return fmt.Errorf("messages[%d]: images are only supported in the last user message", i)
+		}
+	}
+	return nil
+}
+
+func lastUserMessage(messages []def.OpenAIChatMessage) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastUserImages returns the images attached to the final user message.
+func lastUserImages(messages []def.OpenAIChatMessage) []def.OpenAIImageURL {
+	if i := lastUserMessage(messages); i >= 0 {
+		return messages[i].Images
+	}
+	return nil
+}
+
+// uploadImages pushes the images to the Gradio /upload endpoint of the host
+// behind wsAddr and returns the server-side file paths.
+func uploadImages(ctx context.Context, wsAddr string, images []def.OpenAIImageURL) ([]string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, img := range images {
+		data, ext, err := loadImage(ctx, img.URL)
+		if err != nil {
+			return nil, invalidRequest(fmt.Errorf("loading image %d: %w", i, err))
+		}
+		fw, err := mw.CreateFormFile("files", fmt.Sprintf("image%d%s", i, ext))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	base, err := httpBase(wsAddr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/upload", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, upstreamFailure(fmt.Errorf("uploading images: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, upstreamFailure(fmt.Errorf("uploading images: unexpected status %s", resp.Status))
+	}
+
+	var paths []string
+	if err := json.NewDecoder(resp.Body).Decode(&paths); err != nil {
+		return nil, upstreamFailure(fmt.Errorf("decoding upload response: %w", err))
+	}
+	return paths, nil
+}
+
+// loadImage resolves a data: URL or fetches an http(s) URL.
+func loadImage(ctx context.Context, rawURL string) ([]byte, string, error) {
+	if strings.HasPrefix(rawURL, "data:") {
+		meta, payload, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, "", errors.New("only base64 data URLs are supported")
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("decoding data URL: %w", err)
+		}
+		if len(data) > maxImageSize {
+			return nil, "", errors.New("image too large")
+		}
+		return data, imageExt(strings.TrimSuffix(meta, ";base64")), nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", fmt.Errorf("unsupported image url %q", rawURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching image: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxImageSize {
+		return nil, "", errors.New("image too large")
+	}
+	return data, imageExt(resp.Header.Get("Content-Type")), nil
+}
+
+// imageExts are the extensions of the common image types; the mime package
+// would pick rarities like .jfif for JPEG.
+var imageExts = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+func imageExt(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ".png"
+	}
+	if ext, ok := imageExts[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".png"
+}
+
+// httpBase turns wss://host/queue/join into https://host.
+func httpBase(wsAddr string) (string, error) {
+	u, err := url.Parse(wsAddr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/queue/join")
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// appendImageRefs points the upstream at the uploaded files.
+func appendImageRefs(message string, paths []string) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for _, p := range paths {
+		b.WriteString("\n\n![image](file=")
+		b.WriteString(p)
+		b.WriteString(")")
+	}
+	return b.String()
+}
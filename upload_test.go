@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"strings"
+	"testing"
+)
+
+func TestLoadImageDataURL(t *testing.T) {
+	data, ext, err := loadImage(context.Background(), "data:image/jpeg;base64,/9j/4AAQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\xff\xd8\xff\xe0\x00\x10" || ext != ".jpg" {
+		t.Errorf("got %q, %q", data, ext)
+	}
+	for _, url := range []string{
+		"data:image/png,plain",
+		"data:image/png;base64,!!!",
+		"file:///etc/passwd",
+	} {
+		if _, _, err := loadImage(context.Background(), url); err == nil {
+			t.Errorf("loaded %s", url)
+		}
+	}
+}
+
+func TestLoadImageURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big.gif" {
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write(make([]byte, maxImageSize+1))
+			return
+		}
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("RIFF"))
+	}))
+	defer srv.Close()
+
+	// The test server is on loopback, which is refused by default.
+	if _, _, err := loadImage(context.Background(), srv.URL+"/cat.webp"); err == nil ||
+		!strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("fetched from loopback, err = %v", err)
+	}
+
+	defer func(c *http.Client) { imageClient = c }(imageClient)
+	imageClient = newImageClient(true)
+	data, ext, err := loadImage(context.Background(), srv.URL+"/cat.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "RIFF" || ext != ".webp" {
+		t.Errorf("got %q, %q", data, ext)
+	}
+	if _, _, err := loadImage(context.Background(), srv.URL+"/big.gif"); err == nil {
+		t.Error("loaded an image over the size limit")
+	}
+}
+
+func TestCheckImageSupport(t *testing.T) {
+	image := []def.OpenAIImageURL{{URL: "data:image/png;base64,AAAA"}}
+	last := []def.OpenAIChatMessage{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "What is this?", Images: image},
+	}
+	earlier := []def.OpenAIChatMessage{
+		{Role: "user", Content: "What is this?", Images: image},
+		{Role: "assistant", Content: "A cat"},
+		{Role: "user", Content: "Sure?"},
+	}
+	for _, tt := range []struct {
+		model    string
+		messages []def.OpenAIChatMessage
+		ok       bool
+	}{
+		{"gpt-4o", last, true},
+		{"gpt-3.5-turbo", last, false},
+		{"gpt-4o", earlier, false},
+		{"gpt-3.5-turbo", []def.OpenAIChatMessage{{Role: "user", Content: "Hi"}}, true},
+	} {
+		if err := checkImageSupport(tt.model, tt.messages); (err == nil) != tt.ok {
+			t.Errorf("checkImageSupport(%s, %+v) = %v", tt.model, tt.messages, err)
+		}
+	}
+	if got := lastUserImages(last); len(got) != 1 {
+		t.Errorf("lastUserImages = %v", got)
+	}
+}
+
+func TestImageExt(t *testing.T) {
+	for typ, want := range map[string]string{
+		"image/jpeg":               ".jpg",
+		"image/png; charset=utf-8": ".png",
+		"":                         ".png",
+	} {
+		if got := imageExt(typ); got != want {
+			t.Errorf("imageExt(%q) = %q, want %q", typ, got, want)
+		}
+	}
+}
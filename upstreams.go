@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"nixiang-gpt/def"
+	"nixiang-gpt/xueshuhost"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker of an upstream: it opens after breakerThreshold failures in
+// a row and is half open, i.e. due for another try, breakerCooldown later.
+// While it is open, requests fail fast instead of waiting for the upstream.
+const (
+	breakerThreshold = 3
+	breakerCooldown  = 30 * time.Second
+)
+
+// errUpstreamUnavailable fails the requests while the breaker of the upstream
+// is open.
+var errUpstreamUnavailable = &apiError{
+	status:  http.StatusServiceUnavailable,
+	typ:     "upstream_error",
+	code:    "upstream_unavailable",
+	message: "the upstream keeps failing; try again later",
+}
+
+// adminToken is the bearer token /v1/admin/upstreams requires; without one
+// the endpoint is disabled.
+var adminToken string
+
+// healthWindow is the number of latest probes and sessions the error rate of
+// an upstream is computed over.
+const healthWindow = 20
+
+// probeInterval is how often every upstream is probed in the background; 0
+// disables probing.
+var probeInterval = 30 * time.Second
+
+// upstreamHealth tracks how well one upstream has been doing, from the
+// background probes and from the sessions run against it.
+type upstreamHealth struct {
+	addr string
+
+	mu          sync.Mutex
+	results     [healthWindow]bool // true for failures, as a ring
+	samples     int
+	lastCheck   time.Time
+	lastSuccess time.Time
+	lastError   string
+	handshake   time.Duration
+	queueSize   int
+	queueAt     time.Time
+	failures    int // in a row
+	openedAt    time.Time
+}
+
+// health holds the upstreamHealth of every upstream address.
+var health sync.Map
+
+func healthOf(addr string) *upstreamHealth {
+	h, _ := health.LoadOrStore(addr, &upstreamHealth{addr: addr})
+	return h.(*upstreamHealth)
+}
+
+// mirrors are the upstreams to probe: the one requests go to and the known
+// gpt_academic mirrors.
+func mirrors() []string {
+	addrs := []string{upstreamAddr}
+	for _, host := range xueshuhost.Hosts() {
+		if addr := "wss://" + host + "/queue/join"; addr != upstreamAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// observe records the outcome of a probe or session.
+func (h *upstreamHealth) observe(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.results[h.samples%healthWindow] = err != nil
+	h.samples++
+	h.lastCheck = now
+	if err == nil {
+		h.lastSuccess = now
+		h.failures = 0
+		return
+	}
+	h.lastError = err.Error()
+	h.failures++
+	if h.failures >= breakerThreshold {
+		// A failed try while half open opens the breaker again.
+		h.openedAt = now
+	}
+}
+
+// probed records a probe that took d.
+func (h *upstreamHealth) probed(d time.Duration, err error) {
+	if err == nil {
+		h.mu.Lock()
+		h.handshake = d
+		h.mu.Unlock()
+	}
+	h.observe(err)
+}
+
+// queued records the queue size of an estimation.
+func (h *upstreamHealth) queued(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queueSize = size
+	h.queueAt = time.Now()
+}
+
+func (h *upstreamHealth) breaker() string {
+	switch {
+	case h.failures < breakerThreshold:
+		return "closed"
+	case time.Since(h.openedAt) < breakerCooldown:
+		return "open"
+	}
+	return "half_open"
+}
+
+// allow reports whether a session may be run against the upstream. Once the
+// breaker is half open, the session let through is its trial: the breaker
+// stays open for other sessions until the trial's outcome closes it, or for
+// another breakerCooldown.
+func (h *upstreamHealth) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch h.breaker() {
+	case "open":
+		return false
+	case "half_open":
+		h.openedAt = time.Now()
+	}
+	return true
+}
+
+// reachable reports whether the upstream has worked and is not known to be
+// failing. Without probing, an upstream is assumed to work until sessions
+// show otherwise.
+func (h *upstreamHealth) reachable() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return (probeInterval <= 0 || !h.lastSuccess.IsZero()) && h.breaker() != "open"
+}
+
+func (h *upstreamHealth) status() def.UpstreamStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := def.UpstreamStatus{
+		Addr:        h.addr,
+		Breaker:     h.breaker(),
+		LastError:   h.lastError,
+		HandshakeMs: float64(h.handshake) / float64(time.Millisecond),
+	}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck
+		s.LastCheck = &t
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		s.LastSuccess = &t
+	}
+	if !h.queueAt.IsZero() {
+		size, t := h.queueSize, h.queueAt
+		s.QueueSize, s.QueueSizeUpdated = &size, &t
+	}
+	n := h.samples
+	if n > healthWindow {
+		n = healthWindow
+	}
+	failed := 0
+	for _, f := range h.results[:n] {
+		if f {
+			failed++
+		}
+	}
+	if n > 0 {
+		s.ErrorRate = float64(failed) / float64(n)
+	}
+	s.Samples = n
+	return s
+}
+
+// probeUpstream checks that addr would take a request without queueing one:
+// it fetches /config and, for the websocket protocol, waits for the server
+// to ask for the session hash.
+func probeUpstream(ctx context.Context, addr string) error {
+	base, err := httpBase(addr)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/config", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	var config def.GradioConfig
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/config: %s", resp.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("/config: %w", err)
+	}
+	if proto, err := parseProtocol(config); err != nil || proto == protocolSSE {
+		return err
+	}
+
+	t, err := dialWebsocket(addr)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	frame, err := t.receive(ctx, waitTimeout)
+	if err != nil {
+		return err
+	}
+	var msg def.AiResponse
+	if json.Unmarshal(frame, &msg) != nil || msg.Msg != "send_hash" {
+		return errors.New("unexpected handshake message " + string(frame))
+	}
+	return nil
+}
+
+// probeUpstreams probes all mirrors at once.
+func probeUpstreams(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, addr := range mirrors() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeUpstream(ctx, addr)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn("upstream probe failed", "addr", addr, "error", err)
+			}
+			healthOf(addr).probed(time.Since(start), err)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// monitorUpstreams probes the mirrors every probeInterval until ctx is done.
+func monitorUpstreams(ctx context.Context) {
+	if probeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		probeUpstreams(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleHealthz reports that the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the upstream requests go to is reachable. The
+// other mirrors are only probed for the admin view, as no request goes to
+// them.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !healthOf(upstreamAddr).reachable() {
+		http.Error(w, "upstream not reachable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// upstreamAvailable fails a request fast while the breaker of the upstream is
+// open. It is checked once per request, so a half open breaker lets one whole
+// request through as its trial, however many sessions that request runs.
+func upstreamAvailable() error {
+	if !healthOf(upstreamAddr).allow() {
+		return errUpstreamUnavailable
+	}
+	return nil
+}
+
+// requireAdmin lets only requests with adminToken through to next.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeError(w, &apiError{
+				status:  http.StatusUnauthorized,
+				typ:     "invalid_request_error",
+				code:    "invalid_admin_token",
+				message: "this endpoint needs the admin token",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleUpstreams lists the state of every known upstream.
+func handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	response := def.UpstreamsResponse{Upstreams: []def.UpstreamStatus{}}
+	health.Range(func(_, h interface{}) bool {
+		response.Upstreams = append(response.Upstreams, h.(*upstreamHealth).status())
+		return true
+	})
+	for _, addr := range mirrors() {
+		if _, ok := health.Load(addr); !ok {
+			response.Upstreams = append(response.Upstreams, def.UpstreamStatus{Addr: addr, Breaker: "closed"})
+		}
+	}
+	sort.Slice(response.Upstreams, func(i, j int) bool {
+		return response.Upstreams[i].Addr < response.Upstreams[j].Addr
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"nixiang-gpt/def"
+	"testing"
+	"time"
+)
+
+func TestUpstreamBreaker(t *testing.T) {
+	h := &upstreamHealth{addr: "wss://example.com/queue/join"}
+	fail := errors.New("refused")
+	h.observe(nil)
+	for i := 0; i < breakerThreshold-1; i++ {
+		h.observe(fail)
+	}
+	if s := h.status(); s.Breaker != "closed" || s.Samples != breakerThreshold || s.LastError != "refused" {
+		t.Fatalf("below the threshold: %+v", s)
+	}
+	h.observe(fail)
+	if s := h.status(); s.Breaker != "open" || s.ErrorRate != 0.75 || h.reachable() {
+		t.Fatalf("at the threshold: %+v", s)
+	}
+
+	if h.allow() {
+		t.Fatal("open breaker let a session through")
+	}
+
+	h.openedAt = time.Now().Add(-breakerCooldown)
+	if s := h.status(); s.Breaker != "half_open" || !h.reachable() {
+		t.Fatalf("after the cooldown: %+v", s)
+	}
+	if !h.allow() || h.allow() {
+		t.Fatal("half open breaker did not let exactly one trial through")
+	}
+	h.observe(fail)
+	if s := h.status(); s.Breaker != "open" {
+		t.Fatalf("after failing the trial: %+v", s)
+	}
+	h.observe(nil)
+	if s := h.status(); s.Breaker != "closed" {
+		t.Fatalf("after a success: %+v", s)
+	}
+
+	for i := 0; i < 2*healthWindow; i++ {
+		h.observe(nil)
+	}
+	if s := h.status(); s.ErrorRate != 0 || s.Samples != healthWindow {
+		t.Errorf("error rate %v over %d samples", s.ErrorRate, s.Samples)
+	}
+}
+
+func TestProbeUpstream(t *testing.T) {
+	f := useFakeUpstream(t, "Hi")
+	ctx := context.Background()
+	if err := probeUpstream(ctx, f.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.received()) != 0 {
+		t.Error("probe joined the queue")
+	}
+	f.Close()
+	if err := probeUpstream(ctx, f.addr()); err == nil {
+		t.Error("probe of a closed upstream succeeded")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	useFakeUpstream(t, "Hi")
+	get := func(h http.HandlerFunc) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+	if rec := get(handleHealthz); rec.Code != http.StatusOK {
+		t.Errorf("/healthz: %d", rec.Code)
+	}
+	if rec := get(handleReadyz); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before any probe: %d", rec.Code)
+	}
+	// Requests do not go to the other mirrors.
+	const mirror = "wss://mirror.example.com/queue/join"
+	defer health.Delete(mirror)
+	healthOf(mirror).observe(nil)
+	if rec := get(handleReadyz); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with only a mirror reachable: %d", rec.Code)
+	}
+
+	// A session counts like a probe.
+	if rec := postChat(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("chat: %d %s", rec.Code, rec.Body)
+	}
+	if rec := get(handleReadyz); rec.Code != http.StatusOK {
+		t.Errorf("/readyz after a session: %d", rec.Code)
+	}
+
+	var resp def.UpstreamsResponse
+	if err := json.Unmarshal(get(handleUpstreams).Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range resp.Upstreams {
+		if s.Addr != upstreamAddr {
+			continue
+		}
+		if s.Breaker != "closed" || s.Samples != 1 || s.QueueSize == nil || *s.QueueSize != 1 {
+			t.Errorf("status after a session: %+v", s)
+		}
+		return
+	}
+	t.Errorf("%s missing from %+v", upstreamAddr, resp.Upstreams)
+}
+
+func TestUpstreamBreakerFailsFast(t *testing.T) {
+	f := useFakeUpstream(t, "Hi")
+	h := healthOf(upstreamAddr)
+	for i := 0; i < breakerThreshold; i++ {
+		h.observe(errors.New("refused"))
+	}
+	rec := postChat(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	var resp def.OpenAIErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusServiceUnavailable || resp.Error.Code != "upstream_unavailable" {
+		t.Errorf("open breaker: %d %s", rec.Code, rec.Body)
+	}
+	if len(f.received()) != 0 {
+		t.Error("a session was run against an upstream with an open breaker")
+	}
+
+	// The trial of the half open breaker, one request of however many
+	// choices, closes it.
+	h.mu.Lock()
+	h.openedAt = time.Now().Add(-breakerCooldown)
+	h.mu.Unlock()
+	rec = postChat(t, `{"model":"gpt-4o","n":2,"messages":[{"role":"user","content":"Hi"}]}`)
+	var completion def.OpenAIChatCompletion
+	json.Unmarshal(rec.Body.Bytes(), &completion)
+	if rec.Code != http.StatusOK || len(completion.Choices) != 2 {
+		t.Errorf("half open breaker: %d %s", rec.Code, rec.Body)
+	}
+	if s := h.status(); s.Breaker != "closed" {
+		t.Errorf("after a successful trial: %+v", s)
+	}
+}
+
+func TestUpstreamFailureNotCounted(t *testing.T) {
+	f := useFakeUpstream(t, "Hi")
+	h := healthOf(upstreamAddr)
+	for i := 0; i < breakerThreshold; i++ {
+		f.fail(fakeUnsuccessful)
+		rec := postChat(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+		if rec.Code != http.StatusBadGateway || rec.Header().Get(attemptsHeader) != "1" {
+			t.Fatalf("request %d: %d after %s attempts: %s", i, rec.Code, rec.Header().Get(attemptsHeader), rec.Body)
+		}
+	}
+	if n := len(f.received()); n != breakerThreshold {
+		t.Errorf("upstream received %d requests, want %d", n, breakerThreshold)
+	}
+	if s := h.status(); s.Breaker != "closed" || s.ErrorRate != 0 {
+		t.Errorf("after failures reported by the upstream: %+v", s)
+	}
+}
+
+func TestReadyzWithoutProbing(t *testing.T) {
+	useFakeUpstream(t, "Hi")
+	defer func(d time.Duration) { probeInterval = d }(probeInterval)
+	probeInterval = 0
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/readyz without probing: %d", rec.Code)
+	}
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	get := func(auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/admin/upstreams", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	adminToken = ""
+	if code := get("Bearer "); code != http.StatusNotFound {
+		t.Errorf("without an admin token: %d", code)
+	}
+	adminToken = "s3cret"
+	for auth, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"s3cret":        http.StatusUnauthorized,
+		"Bearer s3cret": http.StatusOK,
+	} {
+		if code := get(auth); code != want {
+			t.Errorf("Authorization %q: %d, want %d", auth, code, want)
+		}
+	}
+}
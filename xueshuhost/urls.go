@@ -1,3 +1,8 @@
 package xueshuhost
 
 var urls = []string{"xueshu.52apikey.cn"}
+
+// Hosts returns the hosts of the known gpt_academic mirrors.
+func Hosts() []string {
+	return append([]string(nil), urls...)
+}